@@ -0,0 +1,116 @@
+// © 2021 Ilya Mateyko. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package tsid
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func init() {
+	caddy.RegisterModule(adminAPI{})
+}
+
+// caches holds the WhoIs caches of all provisioned handlers, for the
+// admin API.
+var caches struct {
+	mu  sync.Mutex
+	all map[*whoisCache]bool // guarded by mu
+}
+
+func registerCache(c *whoisCache) {
+	caches.mu.Lock()
+	defer caches.mu.Unlock()
+	if caches.all == nil {
+		caches.all = make(map[*whoisCache]bool)
+	}
+	caches.all[c] = true
+}
+
+func unregisterCache(c *whoisCache) {
+	caches.mu.Lock()
+	defer caches.mu.Unlock()
+	delete(caches.all, c)
+}
+
+// adminAPI is a Caddy admin API module that serves the contents of the
+// WhoIs caches at /tsid/cache. Access control is up to the admin API.
+type adminAPI struct{}
+
+// CaddyModule returns the Caddy module information.
+func (adminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.tsid",
+		New: func() caddy.Module { return new(adminAPI) },
+	}
+}
+
+// Routes implements the caddy.AdminRouter interface.
+func (adminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{{
+		Pattern: "/tsid/cache",
+		Handler: caddy.AdminHandlerFunc(serveCache),
+	}}
+}
+
+// adminCacheEntry is a WhoIs cache entry as returned by the admin API.
+type adminCacheEntry struct {
+	IP      string    `json:"ip"`
+	Login   string    `json:"login,omitempty"`
+	Node    string    `json:"node,omitempty"`
+	Error   string    `json:"error,omitempty"`
+	Expires time.Time `json:"expires"`
+}
+
+// serveCache responds with the fresh entries of all WhoIs caches.
+func serveCache(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method %s not allowed", r.Method),
+		}
+	}
+
+	entries := []adminCacheEntry{}
+	now := time.Now()
+	caches.mu.Lock()
+	for c := range caches.all {
+		c.mu.Lock()
+		for el := c.lru.Front(); el != nil; el = el.Next() {
+			e := el.Value.(*cacheEntry)
+			if !now.Before(e.expires) {
+				continue
+			}
+			ae := adminCacheEntry{IP: e.ip.String(), Expires: e.expires}
+			if e.err != nil {
+				ae.Error = e.err.Error()
+			}
+			if e.whois != nil {
+				if e.whois.UserProfile != nil {
+					ae.Login = e.whois.UserProfile.LoginName
+				}
+				ae.Node = nodeHostname(e.whois.Node)
+			}
+			entries = append(entries, ae)
+		}
+		c.mu.Unlock()
+	}
+	caches.mu.Unlock()
+	slices.SortFunc(entries, func(a, b adminCacheEntry) int {
+		return a.Expires.Compare(b.Expires)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(entries)
+}
+
+// Interface guards.
+var _ caddy.AdminRouter = adminAPI{}
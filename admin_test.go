@@ -0,0 +1,95 @@
+// © 2021 Ilya Mateyko. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package tsid
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"tailscale.com/client/local"
+)
+
+// serveAdminCache returns the entries served by the admin API.
+func serveAdminCache(t *testing.T) []adminCacheEntry {
+	t.Helper()
+	w := httptest.NewRecorder()
+	if err := serveCache(w, httptest.NewRequest(http.MethodGet, "/tsid/cache", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := w.Header().Get("Content-Type"), "application/json"; got != want {
+		t.Errorf("Content-Type = %q, want %q", got, want)
+	}
+	var entries []adminCacheEntry
+	if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestAdminCache(t *testing.T) {
+	// Hide the caches of handlers from other tests.
+	caches.mu.Lock()
+	saved := caches.all
+	caches.all = nil
+	caches.mu.Unlock()
+	t.Cleanup(func() {
+		caches.mu.Lock()
+		caches.all = saved
+		caches.mu.Unlock()
+	})
+
+	lc := newFakeClient()
+	m := &Middleware{}
+	lc.provision(t, m)
+
+	if got := serveAdminCache(t); len(got) != 0 {
+		t.Fatalf("got %d entries before any request, want 0", len(got))
+	}
+
+	for _, addr := range []string{aliceAddr, bobAddr, "100.64.0.2:1234"} {
+		serve(t, m, newRequest(addr))
+	}
+	got := make(map[string]adminCacheEntry)
+	for _, e := range serveAdminCache(t) {
+		got[e.IP] = e
+	}
+	want := map[string]adminCacheEntry{
+		"100.64.0.1": {IP: "100.64.0.1", Login: "alice@example.com", Node: "laptop"},
+		"100.64.0.4": {IP: "100.64.0.4", Login: "bob@example.org", Node: "desktop"},
+		"100.64.0.2": {IP: "100.64.0.2", Error: local.ErrPeerNotFound.Error()},
+	}
+	if len(got) != len(want) {
+		t.Errorf("got %d entries, want %d", len(got), len(want))
+	}
+	for ip, w := range want {
+		g, ok := got[ip]
+		if !ok {
+			t.Errorf("%s: no entry", ip)
+			continue
+		}
+		if g.Expires.IsZero() {
+			t.Errorf("%s: no expiry", ip)
+		}
+		g.Expires = w.Expires
+		if g != w {
+			t.Errorf("%s: got %+v, want %+v", ip, g, w)
+		}
+	}
+
+	m.Cleanup()
+	if got := serveAdminCache(t); len(got) != 0 {
+		t.Errorf("got %d entries after cleanup, want 0", len(got))
+	}
+}
+
+func TestAdminCacheMethod(t *testing.T) {
+	w := httptest.NewRecorder()
+	err := serveCache(w, httptest.NewRequest(http.MethodPost, "/tsid/cache", nil))
+	if err == nil {
+		t.Fatal("got no error for POST")
+	}
+}
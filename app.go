@@ -0,0 +1,141 @@
+// © 2021 Ilya Mateyko. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package tsid
+
+import (
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"tailscale.com/client/local"
+)
+
+func init() {
+	caddy.RegisterModule(&App{})
+	httpcaddyfile.RegisterGlobalOption("tsid", parseCaddyfileApp)
+}
+
+// App is a Caddy app that holds the tailscaled client shared by all tsid
+// handlers, so that they don't create one each. Handlers that set their
+// own socket use a separate client. Clients are kept across config
+// reloads as long as their socket doesn't change.
+type App struct {
+	// Socket is the path to the tailscaled socket. If empty, the
+	// TS_SOCKET and TAILSCALE_SOCKET environment variables are
+	// consulted, in that order, and then the platform default is used.
+	Socket string `json:"socket,omitempty"`
+
+	// WhoIsTimeout is the default WhoIs timeout of handlers that don't
+	// set their own.
+	WhoIsTimeout caddy.Duration `json:"whois_timeout,omitempty"`
+
+	socket string
+	lc     *local.Client
+}
+
+// clients holds the tailscaled clients in use by socket path, so that a
+// client and its connections are reused across config reloads.
+var clients = caddy.NewUsagePool()
+
+// pooledClient is a tailscaled client in clients.
+type pooledClient struct{ *local.Client }
+
+// Destruct implements the caddy.Destructor interface. local.Client holds
+// no resources beyond idle connections, so there is nothing to do.
+func (pooledClient) Destruct() error { return nil }
+
+// loadClient returns the client for socket, creating it if no other
+// handler or app uses it. Each call must be matched by releaseClient.
+func loadClient(socket string) (*local.Client, error) {
+	c, _, err := clients.LoadOrNew(socket, func() (caddy.Destructor, error) {
+		return pooledClient{&local.Client{Socket: socket}}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c.(pooledClient).Client, nil
+}
+
+// releaseClient releases the client for socket returned by loadClient.
+func releaseClient(socket string) {
+	clients.Delete(socket)
+}
+
+// CaddyModule returns the Caddy module information.
+func (*App) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "tsid",
+		New: func() caddy.Module { return new(App) },
+	}
+}
+
+// Provision implements the caddy.Provisioner interface.
+func (a *App) Provision(ctx caddy.Context) error {
+	a.socket = socketPath(a.Socket)
+	var err error
+	a.lc, err = loadClient(a.socket)
+	return err
+}
+
+// Cleanup implements the caddy.CleanerUpper interface.
+func (a *App) Cleanup() error {
+	if a.lc != nil {
+		releaseClient(a.socket)
+	}
+	return nil
+}
+
+// Start implements the caddy.App interface.
+func (*App) Start() error { return nil }
+
+// Stop implements the caddy.App interface.
+func (*App) Stop() error { return nil }
+
+// UnmarshalCaddyfile implements the caddyfile.Unmarshaler interface.
+func (a *App) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "socket":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				a.Socket = d.Val()
+			case "whois_timeout":
+				timeout, err := parseDuration(d)
+				if err != nil {
+					return err
+				}
+				a.WhoIsTimeout = timeout
+			default:
+				return d.Errf("unrecognized subdirective %q", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+// parseCaddyfileApp unmarshals the tsid global option into the tsid app.
+func parseCaddyfileApp(d *caddyfile.Dispenser, _ any) (any, error) {
+	a := &App{}
+	if err := a.UnmarshalCaddyfile(d); err != nil {
+		return nil, err
+	}
+	return httpcaddyfile.App{
+		Name:  "tsid",
+		Value: caddyconfig.JSON(a, nil),
+	}, nil
+}
+
+// Interface guards.
+var (
+	_ caddy.App             = (*App)(nil)
+	_ caddy.Provisioner     = (*App)(nil)
+	_ caddy.CleanerUpper    = (*App)(nil)
+	_ caddyfile.Unmarshaler = (*App)(nil)
+)
@@ -0,0 +1,179 @@
+// © 2021 Ilya Mateyko. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package tsid
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"tailscale.com/client/local"
+)
+
+// newAppContext returns a Caddy context with app configured as the tsid
+// app.
+func newAppContext(t *testing.T, app *App) caddy.Context {
+	t.Helper()
+	ctx, err := caddy.ProvisionContext(&caddy.Config{
+		AppsRaw: caddy.ModuleMap{"tsid": caddyconfig.JSON(app, nil)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ctx
+}
+
+func TestAppSharedClient(t *testing.T) {
+	ctx := newAppContext(t, &App{
+		Socket:       "/run/tailscale/tailscaled.sock",
+		WhoIsTimeout: caddy.Duration(2 * time.Second),
+	})
+
+	var handlers []*Middleware
+	for _, m := range []*Middleware{
+		{},
+		{AllowUsers: []string{"alice@example.com"}},
+		{Socket: "/tmp/tailscaled.sock", WhoIsTimeout: caddy.Duration(time.Second)},
+	} {
+		if err := m.Provision(ctx); err != nil {
+			t.Fatal(err)
+		}
+		handlers = append(handlers, m)
+	}
+	appModule, err := ctx.App("tsid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := appModule.(*App)
+
+	if handlers[0].lc != app.lc || handlers[1].lc != app.lc {
+		t.Error("handlers without a socket don't share the client of the app")
+	}
+	if got := app.lc.Socket; got != "/run/tailscale/tailscaled.sock" {
+		t.Errorf("app socket = %q, want /run/tailscale/tailscaled.sock", got)
+	}
+	if handlers[2].lc == app.lc {
+		t.Error("handler with its own socket shares the client of the app")
+	}
+	if got := handlers[2].lc.(*local.Client).Socket; got != "/tmp/tailscaled.sock" {
+		t.Errorf("handler socket = %q, want /tmp/tailscaled.sock", got)
+	}
+
+	for i, want := range []time.Duration{2 * time.Second, 2 * time.Second, time.Second} {
+		if got := time.Duration(handlers[i].WhoIsTimeout); got != want {
+			t.Errorf("handler %d: WhoIsTimeout = %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestAppDefaults(t *testing.T) {
+	m := &Middleware{}
+	if err := m.Provision(newContext(t)); err != nil {
+		t.Fatal(err)
+	}
+	if got := time.Duration(m.WhoIsTimeout); got != defaultWhoIsTimeout {
+		t.Errorf("WhoIsTimeout = %v, want %v", got, defaultWhoIsTimeout)
+	}
+	if m.lc == nil {
+		t.Error("no client")
+	}
+}
+
+func TestClientReuse(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "tailscaled.sock")
+
+	// Simulate two config reloads: Caddy provisions the new config before
+	// cleaning up the old one.
+	var apps []*App
+	for range 3 {
+		a := &App{Socket: socket}
+		if err := a.Provision(newContext(t)); err != nil {
+			t.Fatal(err)
+		}
+		if len(apps) > 0 {
+			if a.lc != apps[0].lc {
+				t.Error("app client not reused across a reload")
+			}
+			apps[len(apps)-1].Cleanup()
+		}
+		apps = append(apps, a)
+	}
+	if refs, _ := clients.References(socket); refs != 1 {
+		t.Errorf("client has %d references, want 1", refs)
+	}
+
+	// Handlers with the same socket share the client too.
+	m := &Middleware{Socket: socket}
+	if err := m.Provision(newContext(t)); err != nil {
+		t.Fatal(err)
+	}
+	if m.lc != apps[0].lc {
+		t.Error("handler doesn't reuse the client for its socket")
+	}
+
+	m.Cleanup()
+	apps[len(apps)-1].Cleanup()
+	if refs, ok := clients.References(socket); ok {
+		t.Errorf("client still has %d references after cleanup", refs)
+	}
+
+	a := &App{Socket: socket}
+	if err := a.Provision(newContext(t)); err != nil {
+		t.Fatal(err)
+	}
+	defer a.Cleanup()
+	if a.lc == apps[0].lc {
+		t.Error("released client reused")
+	}
+}
+
+func TestAppUnmarshalCaddyfile(t *testing.T) {
+	cases := map[string]struct {
+		in      string
+		want    *App
+		wantErr bool
+	}{
+		"empty": {
+			in:   `tsid`,
+			want: &App{},
+		},
+		"options": {
+			in: `tsid {
+				socket /run/tailscale/tailscaled.sock
+				whois_timeout 2s
+			}`,
+			want: &App{Socket: "/run/tailscale/tailscaled.sock", WhoIsTimeout: caddy.Duration(2 * time.Second)},
+		},
+		"argument": {
+			in:      `tsid yes`,
+			wantErr: true,
+		},
+		"unknown subdirective": {
+			in: `tsid {
+				allow_users alice@example.com
+			}`,
+			wantErr: true,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			a := &App{}
+			err := a.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tc.in))
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("got error %v, want error: %v", err, tc.wantErr)
+			}
+			if tc.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(a, tc.want) {
+				t.Errorf("got %+v, want %+v", a, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+// © 2021 Ilya Mateyko. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package tsid
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"net/netip"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+	"tailscale.com/client/local"
+	"tailscale.com/client/tailscale/apitype"
+)
+
+// whoisCache caches WhoIs responses by remote IP. Addresses that don't
+// belong to any peer are cached too, but usually for a shorter time, so
+// nodes that join the tailnet later aren't blocked for long. Past
+// maxEntries, the least recently used entries are evicted.
+//
+// If perConn is set, entries are only used for requests from the client
+// address (IP and port) they were looked up for, so an IP that was
+// reassigned to another node is looked up again on the next connection.
+type whoisCache struct {
+	ttl        time.Duration
+	negTTL     time.Duration
+	maxEntries int
+	perConn    bool
+	group      singleflight.Group // keyed by IP
+
+	mu      sync.Mutex
+	entries map[netip.Addr]*list.Element // of *cacheEntry, guarded by mu
+	lru     list.List                    // of *cacheEntry, most recently used first, guarded by mu
+}
+
+// cacheEntry is a cached WhoIs lookup.
+type cacheEntry struct {
+	ip      netip.Addr
+	conn    string // client address the entry was looked up for
+	whois   *apitype.WhoIsResponse
+	err     error
+	expires time.Time
+}
+
+func newWhoisCache(ttl, negTTL time.Duration, maxEntries int, perConn bool) *whoisCache {
+	return &whoisCache{
+		ttl:        ttl,
+		negTTL:     negTTL,
+		maxEntries: maxEntries,
+		perConn:    perConn,
+		entries:    make(map[netip.Addr]*list.Element),
+	}
+}
+
+// get returns the WhoIs response for ip, the address of a client that
+// connected from conn, calling lookup if there is no fresh cached
+// response, how long the lookup took and whether the response was
+// cached. Concurrent misses for the same ip share a single lookup, which
+// isn't canceled with ctx, since other requests may be waiting for it:
+// lookup must limit it itself. Failed lookups are not cached, except for
+// local.ErrPeerNotFound.
+func (c *whoisCache) get(ctx context.Context, ip netip.Addr, conn string, lookup func(context.Context) (*apitype.WhoIsResponse, error)) (whois *apitype.WhoIsResponse, latency time.Duration, cached bool, err error) {
+	if e, ok := c.lookup(ip, conn); ok {
+		return e.whois, 0, true, e.err
+	}
+
+	ch := c.group.DoChan(ip.String(), func() (any, error) {
+		start := time.Now()
+		whois, err := lookup(context.WithoutCancel(ctx))
+		res := lookupResult{whois: whois, latency: time.Since(start)}
+		var ttl time.Duration
+		switch {
+		case err == nil:
+			ttl = c.ttl
+		case errors.Is(err, local.ErrPeerNotFound):
+			ttl = c.negTTL
+		default:
+			return res, err
+		}
+		c.add(&cacheEntry{ip: ip, conn: conn, whois: whois, err: err, expires: time.Now().Add(ttl)})
+		return res, err
+	})
+	select {
+	case res := <-ch:
+		r := res.Val.(lookupResult)
+		return r.whois, r.latency, false, res.Err
+	case <-ctx.Done():
+		return nil, 0, false, ctx.Err()
+	}
+}
+
+// lookupResult is the result of a lookup shared by whoisCache.get.
+type lookupResult struct {
+	whois   *apitype.WhoIsResponse
+	latency time.Duration
+}
+
+// lookup returns the fresh entry for ip and marks it as recently used.
+// Expired entries are removed. With perConn, entries for another conn
+// are ignored.
+func (c *whoisCache) lookup(ip netip.Addr, conn string) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[ip]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*cacheEntry)
+	if !time.Now().Before(e.expires) {
+		c.lru.Remove(el)
+		delete(c.entries, ip)
+		return nil, false
+	}
+	if c.perConn && e.conn != conn {
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return e, true
+}
+
+// add adds or replaces the entry for e.ip, evicting the least recently
+// used entries if the cache is full.
+func (c *whoisCache) add(e *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[e.ip]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[e.ip] = c.lru.PushFront(e)
+	for c.lru.Len() > c.maxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).ip)
+	}
+}
+
+// clear removes all entries from the cache.
+func (c *whoisCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	clear(c.entries)
+	c.lru.Init()
+}
@@ -0,0 +1,291 @@
+// © 2021 Ilya Mateyko. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package tsid
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"tailscale.com/client/local"
+	"tailscale.com/client/tailscale/apitype"
+)
+
+// countingLookup returns a lookup function for whoisCache.get that
+// answers with whois and err and counts its calls in n.
+func countingLookup(n *atomic.Int32, whois *apitype.WhoIsResponse, err error) func(context.Context) (*apitype.WhoIsResponse, error) {
+	return func(context.Context) (*apitype.WhoIsResponse, error) {
+		n.Add(1)
+		time.Sleep(10 * time.Millisecond)
+		return whois, err
+	}
+}
+
+func TestWhoisCache(t *testing.T) {
+	c := newWhoisCache(time.Minute, time.Minute, defaultCacheMaxEntries, false)
+	ip := netip.MustParseAddr("100.64.0.1")
+	var n atomic.Int32
+
+	for i := range 2 {
+		got, _, cached, err := c.get(context.Background(), ip, "", countingLookup(&n, alice, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != alice {
+			t.Fatalf("got %v, want alice", got)
+		}
+		if want := i > 0; cached != want {
+			t.Errorf("lookup %d: cached = %v, want %v", i, cached, want)
+		}
+	}
+	if got := n.Load(); got != 1 {
+		t.Errorf("lookup called %d times within TTL, want 1", got)
+	}
+
+	// Expire the entry.
+	c.mu.Lock()
+	c.entries[ip].Value.(*cacheEntry).expires = time.Now().Add(-time.Second)
+	c.mu.Unlock()
+	if _, _, _, err := c.get(context.Background(), ip, "", countingLookup(&n, alice, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if got := n.Load(); got != 2 {
+		t.Errorf("lookup called %d times after expiry, want 2", got)
+	}
+}
+
+func TestWhoisCacheErrorsNotCached(t *testing.T) {
+	c := newWhoisCache(time.Minute, time.Minute, defaultCacheMaxEntries, false)
+	ip := netip.MustParseAddr("100.64.0.1")
+	var n atomic.Int32
+	errFailed := errors.New("failed")
+
+	for range 2 {
+		if _, _, _, err := c.get(context.Background(), ip, "", countingLookup(&n, nil, errFailed)); !errors.Is(err, errFailed) {
+			t.Fatalf("got error %v, want %v", err, errFailed)
+		}
+	}
+	if got := n.Load(); got != 2 {
+		t.Errorf("lookup called %d times, want 2", got)
+	}
+}
+
+func TestWhoisCacheConcurrentMisses(t *testing.T) {
+	c := newWhoisCache(time.Minute, time.Minute, defaultCacheMaxEntries, false)
+	ip := netip.MustParseAddr("100.64.0.1")
+	var n atomic.Int32
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, _, err := c.get(context.Background(), ip, "", countingLookup(&n, alice, nil)); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := n.Load(); got != 1 {
+		t.Errorf("lookup called %d times, want 1", got)
+	}
+}
+
+func TestWhoisCacheNegative(t *testing.T) {
+	c := newWhoisCache(time.Hour, time.Minute, defaultCacheMaxEntries, false)
+	peer := netip.MustParseAddr("100.64.0.1")
+	stranger := netip.MustParseAddr("100.64.0.2")
+	var n, negN atomic.Int32
+
+	get := func(ip netip.Addr, n *atomic.Int32, whois *apitype.WhoIsResponse, err error) {
+		t.Helper()
+		if _, _, _, gotErr := c.get(context.Background(), ip, "", countingLookup(n, whois, err)); !errors.Is(gotErr, err) {
+			t.Fatalf("got error %v, want %v", gotErr, err)
+		}
+	}
+
+	for range 2 {
+		get(peer, &n, alice, nil)
+		get(stranger, &negN, nil, local.ErrPeerNotFound)
+	}
+	if got := negN.Load(); got != 1 {
+		t.Errorf("lookup for unknown peer called %d times within negative TTL, want 1", got)
+	}
+
+	// Expire the negative entry only, as if negative_cache_ttl passed.
+	c.mu.Lock()
+	c.entries[stranger].Value.(*cacheEntry).expires = time.Now().Add(-time.Second)
+	c.mu.Unlock()
+	get(peer, &n, alice, nil)
+	get(stranger, &negN, nil, local.ErrPeerNotFound)
+	if got := negN.Load(); got != 2 {
+		t.Errorf("lookup for unknown peer called %d times after expiry, want 2", got)
+	}
+	if got := n.Load(); got != 1 {
+		t.Errorf("lookup for peer called %d times, want 1", got)
+	}
+}
+
+func TestWhoisCacheTTLs(t *testing.T) {
+	c := newWhoisCache(time.Hour, time.Minute, defaultCacheMaxEntries, false)
+	peer := netip.MustParseAddr("100.64.0.1")
+	stranger := netip.MustParseAddr("100.64.0.2")
+	var n atomic.Int32
+	now := time.Now()
+
+	c.get(context.Background(), peer, "", countingLookup(&n, alice, nil))
+	c.get(context.Background(), stranger, "", countingLookup(&n, nil, local.ErrPeerNotFound))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if got := c.entries[peer].Value.(*cacheEntry).expires.Sub(now); got < 59*time.Minute || got > time.Hour+time.Second {
+		t.Errorf("peer entry expires in %v, want about 1h", got)
+	}
+	if got := c.entries[stranger].Value.(*cacheEntry).expires.Sub(now); got < 59*time.Second || got > time.Minute+time.Second {
+		t.Errorf("unknown peer entry expires in %v, want about 1m", got)
+	}
+}
+
+func TestWhoisCacheEviction(t *testing.T) {
+	c := newWhoisCache(time.Hour, time.Hour, 2, false)
+	a := netip.MustParseAddr("100.64.0.1")
+	b := netip.MustParseAddr("100.64.0.2")
+	d := netip.MustParseAddr("100.64.0.3")
+	var n atomic.Int32
+
+	get := func(ip netip.Addr) {
+		t.Helper()
+		if _, _, _, err := c.get(context.Background(), ip, "", countingLookup(&n, alice, nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	get(a)
+	get(b)
+	get(a) // a is now more recently used than b
+	get(d) // evicts b
+	if got := n.Load(); got != 3 {
+		t.Fatalf("lookup called %d times, want 3", got)
+	}
+
+	c.mu.Lock()
+	var order []netip.Addr
+	for el := c.lru.Front(); el != nil; el = el.Next() {
+		order = append(order, el.Value.(*cacheEntry).ip)
+	}
+	c.mu.Unlock()
+	if want := []netip.Addr{d, a}; !slices.Equal(order, want) {
+		t.Errorf("cached %v, want %v", order, want)
+	}
+
+	get(a)
+	if got := n.Load(); got != 3 {
+		t.Errorf("lookup for a called again after eviction of b")
+	}
+	get(b)
+	if got := n.Load(); got != 4 {
+		t.Errorf("lookup for evicted b not called again")
+	}
+}
+
+func TestWhoisCacheMaxEntries(t *testing.T) {
+	const maxEntries = 16
+	c := newWhoisCache(time.Hour, time.Hour, maxEntries, false)
+	var n atomic.Int32
+
+	var wg sync.WaitGroup
+	for i := range 200 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ip := netip.MustParseAddr(fmt.Sprintf("100.64.%d.%d", i/100, i%100+1))
+			if _, _, _, err := c.get(context.Background(), ip, "", countingLookup(&n, alice, nil)); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if got := len(c.entries); got != maxEntries {
+		t.Errorf("cache holds %d entries, want %d", got, maxEntries)
+	}
+	if got := c.lru.Len(); got != len(c.entries) {
+		t.Errorf("LRU list holds %d entries, map holds %d", got, len(c.entries))
+	}
+}
+
+func TestWhoisCachePerConn(t *testing.T) {
+	ip := netip.MustParseAddr("100.64.0.1")
+	for _, perConn := range []bool{false, true} {
+		c := newWhoisCache(time.Hour, time.Hour, defaultCacheMaxEntries, perConn)
+		var n atomic.Int32
+		for _, conn := range []string{"100.64.0.1:1234", "100.64.0.1:1234", "100.64.0.1:5678"} {
+			if _, _, _, err := c.get(context.Background(), ip, conn, countingLookup(&n, alice, nil)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		want := int32(1)
+		if perConn {
+			want = 2
+		}
+		if got := n.Load(); got != want {
+			t.Errorf("perConn %v: lookup called %d times, want %d", perConn, got, want)
+		}
+	}
+}
+
+func TestWhoisCacheLeaderCanceled(t *testing.T) {
+	c := newWhoisCache(time.Minute, time.Minute, defaultCacheMaxEntries, false)
+	ip := netip.MustParseAddr("100.64.0.1")
+	started := make(chan struct{})
+	lookup := func(ctx context.Context) (*apitype.WhoIsResponse, error) {
+		close(started)
+		select {
+		case <-time.After(50 * time.Millisecond):
+			return alice, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	// The first request starts the lookup and goes away.
+	leaderCtx, cancel := context.WithCancel(context.Background())
+	leaderDone := make(chan error)
+	go func() {
+		_, _, _, err := c.get(leaderCtx, ip, "", lookup)
+		leaderDone <- err
+	}()
+	<-started
+
+	// The second one waits for the same lookup.
+	waiterDone := make(chan error)
+	go func() {
+		whois, latency, cached, err := c.get(context.Background(), ip, "", lookup)
+		if err == nil && (whois != alice || !cached && latency <= 0) {
+			err = fmt.Errorf("got %v after %v, want alice", whois, latency)
+		}
+		waiterDone <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	if err := <-leaderDone; !errors.Is(err, context.Canceled) {
+		t.Errorf("leader: got error %v, want %v", err, context.Canceled)
+	}
+	if err := <-waiterDone; err != nil {
+		t.Errorf("waiter: %v", err)
+	}
+	if _, _, cached, err := c.get(context.Background(), ip, "", lookup); !cached || err != nil {
+		t.Errorf("got cached = %v (err: %v) after the shared lookup, want cached", cached, err)
+	}
+}
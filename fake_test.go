@@ -0,0 +1,276 @@
+// © 2021 Ilya Mateyko. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package tsid
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"tailscale.com/client/local"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+)
+
+// fakeClient is a fake localClient that answers from memory, so tests
+// don't need a running tailscaled.
+type fakeClient struct {
+	peers  map[netip.Addr]*apitype.WhoIsResponse
+	status *ipnstate.Status
+	delay  time.Duration // before each response
+	err    error         // if set, returned by all methods
+
+	// whoisFailures is how many of the next WhoIs calls fail with
+	// errConnRefused.
+	whoisFailures atomic.Int32
+
+	bus *local.Client // if set, used for WatchIPNBus
+
+	whoisCalls  atomic.Int32
+	statusCalls atomic.Int32
+}
+
+var _ LocalClient = (*fakeClient)(nil)
+
+// errTailscaledDown is returned by a fakeClient that simulates an
+// unreachable tailscaled.
+var errTailscaledDown = errors.New("dial unix /var/run/tailscale/tailscaled.sock: connect: connection refused")
+
+// errConnRefused is returned by WhoIs of a fakeClient with whoisFailures
+// set. Unlike errTailscaledDown, it's a connection error that is retried.
+var errConnRefused = &net.OpError{Op: "dial", Net: "unix", Err: syscall.ECONNREFUSED}
+
+// alice is a peer used in tests.
+var alice = &apitype.WhoIsResponse{
+	Node: &tailcfg.Node{Name: "laptop.example.ts.net.", ComputedName: "laptop"},
+	UserProfile: &tailcfg.UserProfile{
+		ID:            12345,
+		LoginName:     "alice@example.com",
+		DisplayName:   "Alice",
+		ProfilePicURL: "https://example.com/alice.png",
+	},
+	CapMap: tailcfg.PeerCapMap{
+		"example.com/cap/admin": {`{"sites":["wiki"]}`, `{"sites":["blog"]}`},
+		"example.com/cap/user":  nil,
+	},
+}
+
+// bob is another peer used in tests.
+var bob = &apitype.WhoIsResponse{
+	Node: &tailcfg.Node{Name: "desktop.example.ts.net.", ComputedName: "desktop"},
+	UserProfile: &tailcfg.UserProfile{
+		ID:          23456,
+		LoginName:   "bob@example.org",
+		DisplayName: "Bob",
+	},
+	CapMap: tailcfg.PeerCapMap{
+		"example.com/cap/user": {`{}`},
+	},
+}
+
+// ci is a tagged node used in tests.
+var ci = &apitype.WhoIsResponse{
+	Node: &tailcfg.Node{Name: "ci.example.ts.net.", ComputedName: "ci", Tags: []string{"tag:ci"}},
+	UserProfile: &tailcfg.UserProfile{
+		ID:          34567,
+		LoginName:   "tagged-devices",
+		DisplayName: "Tagged Devices",
+	},
+}
+
+// Addresses of the peers used in tests.
+const (
+	aliceAddr = "100.64.0.1:1234"
+	bobAddr   = "100.64.0.4:1234"
+	ciAddr    = "100.64.0.5:1234"
+)
+
+// newFakeClient returns a fakeClient that knows about alice, bob and ci.
+func newFakeClient() *fakeClient {
+	return &fakeClient{
+		peers: map[netip.Addr]*apitype.WhoIsResponse{
+			netip.MustParseAddrPort(aliceAddr).Addr(): alice,
+			netip.MustParseAddrPort(bobAddr).Addr():   bob,
+			netip.MustParseAddrPort(ciAddr).Addr():    ci,
+		},
+		status: &ipnstate.Status{
+			BackendState:   "Running",
+			MagicDNSSuffix: "example.ts.net",
+			Self:           &ipnstate.PeerStatus{DNSName: "server.example.ts.net."},
+			CurrentTailnet: &ipnstate.TailnetStatus{
+				Name:           "example.com",
+				MagicDNSSuffix: "example.ts.net",
+			},
+		},
+	}
+}
+
+// wait waits for the configured delay or until ctx is done.
+func (lc *fakeClient) wait(ctx context.Context) error {
+	if lc.err != nil {
+		return lc.err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case <-time.After(lc.delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (lc *fakeClient) WhoIs(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+	lc.whoisCalls.Add(1)
+	if lc.whoisFailures.Add(-1) >= 0 {
+		return nil, errConnRefused
+	}
+	if err := lc.wait(ctx); err != nil {
+		return nil, err
+	}
+	ip, err := netip.ParseAddr(remoteAddr)
+	if err != nil {
+		ap, err := netip.ParseAddrPort(remoteAddr)
+		if err != nil {
+			return nil, err
+		}
+		ip = ap.Addr()
+	}
+	whois, ok := lc.peers[ip]
+	if !ok {
+		return nil, local.ErrPeerNotFound
+	}
+	return whois, nil
+}
+
+func (lc *fakeClient) StatusWithoutPeers(ctx context.Context) (*ipnstate.Status, error) {
+	lc.statusCalls.Add(1)
+	if err := lc.wait(ctx); err != nil {
+		return nil, err
+	}
+	return lc.status, nil
+}
+
+// newContext returns a Caddy context with an empty config for
+// provisioning handlers in tests.
+func newContext(t testing.TB) caddy.Context {
+	t.Helper()
+	ctx, err := caddy.ProvisionContext(&caddy.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ctx
+}
+
+func (lc *fakeClient) WatchIPNBus(ctx context.Context, mask ipn.NotifyWatchOpt) (*local.IPNBusWatcher, error) {
+	if lc.bus == nil {
+		return nil, errors.New("IPN bus not available")
+	}
+	return lc.bus.WatchIPNBus(ctx, mask)
+}
+
+// serveIPNBus makes lc stream the notifications sent on the returned
+// channel to IPN bus watchers.
+func (lc *fakeClient) serveIPNBus(t *testing.T) chan<- ipn.Notify {
+	t.Helper()
+	notify := make(chan ipn.Notify)
+	stop := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/localapi/v0/watch-ipn-bus" {
+			http.NotFound(w, r)
+			return
+		}
+		w.(http.Flusher).Flush()
+		enc := json.NewEncoder(w)
+		for {
+			select {
+			case n := <-notify:
+				if err := enc.Encode(n); err != nil {
+					return
+				}
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			case <-stop:
+				return
+			}
+		}
+	}))
+	t.Cleanup(func() {
+		close(stop)
+		srv.Close()
+	})
+	lc.bus = &local.Client{
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "tcp", srv.Listener.Addr().String())
+		},
+	}
+	return notify
+}
+
+// provision provisions m to talk to lc.
+func (lc *fakeClient) provision(t testing.TB, m *Middleware) {
+	t.Helper()
+	m.Client = lc
+	if err := m.Provision(newContext(t)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newRequest returns a request from remoteAddr with the context that
+// Caddy sets up for placeholders.
+func newRequest(remoteAddr string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	r.RemoteAddr = remoteAddr
+	r = r.WithContext(context.WithValue(r.Context(), caddyhttp.VarsCtxKey, map[string]any{}))
+	caddyhttp.NewTestReplacer(r)
+	return r
+}
+
+// serve passes r through m and reports whether the next handler was
+// called.
+func serve(t *testing.T, m *Middleware, r *http.Request) (*httptest.ResponseRecorder, bool, error) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	var called bool
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		called = true
+		return nil
+	})
+	err := m.ServeHTTP(w, r, next)
+	return w, called, err
+}
+
+// statusCode returns the HTTP status of a handler error, or 0 if err is
+// nil.
+func statusCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var herr caddyhttp.HandlerError
+	if errors.As(err, &herr) {
+		return herr.StatusCode
+	}
+	return -1
+}
+
+// getVar returns the placeholder name set for r.
+func getVar(r *http.Request, name string) any {
+	return caddyhttp.GetVar(r.Context(), name)
+}
@@ -0,0 +1,104 @@
+// © 2021 Ilya Mateyko. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package tsid
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+
+	"tailscale.com/client/local"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/net/tsaddr"
+)
+
+// WhoIser identifies Tailscale peers by address. It's implemented by
+// local.Client and tsidtest.Client.
+type WhoIser interface {
+	WhoIs(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error)
+}
+
+// Identity is the identity of a Tailscale peer, as returned by Identify.
+type Identity struct {
+	// Login is the login name of the user, usually an email address. For
+	// tagged nodes, it's the "tagged-devices" pseudo-user.
+	Login string
+	// DisplayName is the display name of the user.
+	DisplayName string
+	// ProfilePicURL is the URL of the profile picture of the user.
+	ProfilePicURL string
+	// UserID is the decimal form of the stable ID of the user.
+	UserID string
+	// NodeName is the machine name of the node.
+	NodeName string
+	// NodeID is the stable ID of the node.
+	NodeID string
+	// Tags are the ACL tags of the node.
+	Tags []string
+
+	// WhoIs is the full WhoIs response.
+	WhoIs *apitype.WhoIsResponse
+}
+
+// Identify identifies the client with the address remoteAddr (an IP
+// with an optional port) using lc, without any of the caching or access
+// rules of the handler. It returns ErrNotTailscaleIP if remoteAddr isn't
+// a Tailscale IP and an error wrapping ErrNotAuthorized if it doesn't
+// belong to any peer.
+func Identify(ctx context.Context, lc WhoIser, remoteAddr string) (*Identity, error) {
+	ip, addr, err := parseRemoteAddr(remoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	if !tsaddr.IsTailscaleIP(ip) {
+		return nil, ErrNotTailscaleIP
+	}
+	whois, err := lc.WhoIs(ctx, addr)
+	if errors.Is(err, local.ErrPeerNotFound) {
+		return nil, fmt.Errorf("%w: %w", ErrNotAuthorized, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newIdentity(whois), nil
+}
+
+// parseRemoteAddr parses an IP with an optional port and returns the IP
+// and the address to look up with WhoIs. Dual-stack listeners report
+// IPv4 clients as IPv4-mapped IPv6 addresses, which are not recognized
+// as Tailscale IPs, so they are unmapped.
+func parseRemoteAddr(remoteAddr string) (ip netip.Addr, addr string, err error) {
+	if ap, err := netip.ParseAddrPort(remoteAddr); err == nil {
+		ip = ap.Addr().Unmap()
+		return ip, netip.AddrPortFrom(ip, ap.Port()).String(), nil
+	}
+	ip, err = netip.ParseAddr(remoteAddr)
+	if err != nil {
+		return netip.Addr{}, "", fmt.Errorf("invalid remote address %q", remoteAddr)
+	}
+	ip = ip.Unmap()
+	return ip, ip.String(), nil
+}
+
+// newIdentity returns the Identity from whois.
+func newIdentity(whois *apitype.WhoIsResponse) *Identity {
+	id := &Identity{
+		NodeName: nodeHostname(whois.Node),
+		NodeID:   nodeID(whois.Node),
+		WhoIs:    whois,
+	}
+	if p := whois.UserProfile; p != nil {
+		id.Login = p.LoginName
+		id.DisplayName = p.DisplayName
+		id.ProfilePicURL = p.ProfilePicURL
+		id.UserID = userID(p)
+	}
+	if whois.Node != nil {
+		id.Tags = slices.Clone(whois.Node.Tags)
+	}
+	return id
+}
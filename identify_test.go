@@ -0,0 +1,137 @@
+// © 2021 Ilya Mateyko. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package tsid
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"tailscale.com/client/local"
+)
+
+func TestIdentify(t *testing.T) {
+	lc := newFakeClient()
+
+	cases := map[string]struct {
+		remoteAddr string
+		want       *Identity
+	}{
+		"user": {
+			remoteAddr: aliceAddr,
+			want: &Identity{
+				Login:         "alice@example.com",
+				DisplayName:   "Alice",
+				ProfilePicURL: "https://example.com/alice.png",
+				UserID:        "12345",
+				NodeName:      "laptop",
+				WhoIs:         alice,
+			},
+		},
+		"tagged": {
+			remoteAddr: ciAddr,
+			want: &Identity{
+				Login:       "tagged-devices",
+				DisplayName: "Tagged Devices",
+				UserID:      "34567",
+				NodeName:    "ci",
+				Tags:        []string{"tag:ci"},
+				WhoIs:       ci,
+			},
+		},
+		"without port": {
+			remoteAddr: "100.64.0.4",
+			want: &Identity{
+				Login:       "bob@example.org",
+				DisplayName: "Bob",
+				UserID:      "23456",
+				NodeName:    "desktop",
+				WhoIs:       bob,
+			},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got, err := Identify(context.Background(), lc, tc.remoteAddr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestIdentifyErrors(t *testing.T) {
+	cases := map[string]struct {
+		remoteAddr string
+		lcErr      error
+		wantErr    []error
+	}{
+		"not tailscale": {
+			remoteAddr: "192.0.2.1:1234",
+			wantErr:    []error{ErrNotTailscaleIP},
+		},
+		"loopback": {
+			remoteAddr: "127.0.0.1:1234",
+			wantErr:    []error{ErrNotTailscaleIP},
+		},
+		"unknown peer": {
+			remoteAddr: "100.64.0.2:1234",
+			wantErr:    []error{ErrNotAuthorized, local.ErrPeerNotFound},
+		},
+		"tailscaled down": {
+			remoteAddr: aliceAddr,
+			lcErr:      errTailscaledDown,
+			wantErr:    []error{errTailscaledDown},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			lc := newFakeClient()
+			lc.err = tc.lcErr
+			id, err := Identify(context.Background(), lc, tc.remoteAddr)
+			if err == nil {
+				t.Fatalf("got %+v, want error", id)
+			}
+			for _, want := range tc.wantErr {
+				if !errors.Is(err, want) {
+					t.Errorf("got error %v, want %v", err, want)
+				}
+			}
+			if tc.lcErr != nil && errors.Is(err, ErrNotAuthorized) {
+				t.Errorf("got error %v, want it not to be ErrNotAuthorized", err)
+			}
+		})
+	}
+}
+
+func TestIdentifyIPv4Mapped(t *testing.T) {
+	// The fake client doesn't unmap addresses itself, so the lookup only
+	// succeeds if Identify passes the unmapped address to WhoIs.
+	lc := newFakeClient()
+	id, err := Identify(context.Background(), lc, "[::ffff:100.64.0.1]:1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.Login != "alice@example.com" {
+		t.Errorf("got login %q, want alice@example.com", id.Login)
+	}
+}
+
+func TestIdentifyInvalidAddr(t *testing.T) {
+	lc := newFakeClient()
+	for _, addr := range []string{"", "invalid", "100.64.0.1:port"} {
+		_, err := Identify(context.Background(), lc, addr)
+		if err == nil || errors.Is(err, ErrNotTailscaleIP) || errors.Is(err, ErrNotAuthorized) {
+			t.Errorf("%q: got error %v, want invalid address", addr, err)
+		}
+	}
+	if got := lc.whoisCalls.Load(); got != 0 {
+		t.Errorf("WhoIs called %d times for invalid addresses, want 0", got)
+	}
+}
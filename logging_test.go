@@ -0,0 +1,265 @@
+// © 2021 Ilya Mateyko. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package tsid
+
+import (
+	"fmt"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// observe replaces the logger of m with one that records all entries.
+func observe(m *Middleware) *observer.ObservedLogs {
+	core, logs := observer.New(zapcore.DebugLevel)
+	m.logger = zap.New(core)
+	return logs
+}
+
+func TestLogDenied(t *testing.T) {
+	lc := newFakeClient()
+	m := &Middleware{AllowUsers: []string{"alice@example.com"}}
+	lc.provision(t, m)
+	logs := observe(m)
+
+	serve(t, m, newRequest(bobAddr))
+
+	entries := logs.All()
+	if len(entries) != 1 {
+		t.Fatalf("got %d log entries, want 1", len(entries))
+	}
+	e := entries[0]
+	if e.Level != zapcore.DebugLevel {
+		t.Errorf("logged at %v, want debug", e.Level)
+	}
+	fields := e.ContextMap()
+	for k, want := range map[string]any{
+		"remote_ip": "100.64.0.4",
+		"login":     "bob@example.org",
+		"reason":    ErrNotAuthorized.Error(),
+	} {
+		if got := fields[k]; got != want {
+			t.Errorf("%s = %v, want %v", k, got, want)
+		}
+	}
+	if _, ok := fields["whois_latency"]; !ok {
+		t.Error("whois_latency not logged")
+	}
+}
+
+func TestLogLevels(t *testing.T) {
+	lc := newFakeClient()
+
+	cases := map[string]struct {
+		down       bool
+		remoteAddr string
+		wantLevel  zapcore.Level
+	}{
+		"allowed":       {remoteAddr: aliceAddr, wantLevel: zapcore.DebugLevel},
+		"not tailscale": {remoteAddr: "192.0.2.1:1234", wantLevel: zapcore.DebugLevel},
+		"unknown peer":  {remoteAddr: "100.64.0.2:1234", wantLevel: zapcore.DebugLevel},
+		"tailscaled down": {
+			down:       true,
+			remoteAddr: aliceAddr,
+			wantLevel:  zapcore.WarnLevel,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			m := &Middleware{}
+			lc := lc
+			if tc.down {
+				lc = newFakeClient()
+				lc.err = errTailscaledDown
+			}
+			lc.provision(t, m)
+			logs := observe(m)
+
+			serve(t, m, newRequest(tc.remoteAddr))
+
+			for _, e := range logs.All() {
+				if e.Level > tc.wantLevel {
+					t.Errorf("logged %q at %v, want at most %v", e.Message, e.Level, tc.wantLevel)
+				}
+			}
+			if logs.FilterLevelExact(tc.wantLevel).Len() == 0 {
+				t.Errorf("nothing logged at %v", tc.wantLevel)
+			}
+		})
+	}
+}
+
+func TestAudit(t *testing.T) {
+	lc := newFakeClient()
+	m := &Middleware{Audit: true, AllowUsers: []string{"alice@example.com"}}
+	lc.provision(t, m)
+
+	cases := map[string]struct {
+		remoteAddr        string
+		wantLogged        bool
+		wantReason        string
+		wantAuthenticated any
+		wantEmail         any
+	}{
+		"allowed": {
+			remoteAddr:        aliceAddr,
+			wantAuthenticated: "true",
+			wantEmail:         "alice@example.com",
+		},
+		"not authorized": {
+			remoteAddr:        bobAddr,
+			wantLogged:        true,
+			wantReason:        ErrNotAuthorized.Error(),
+			wantAuthenticated: "true",
+			wantEmail:         "bob@example.org",
+		},
+		"unknown peer": {
+			remoteAddr:        "100.64.0.2:1234",
+			wantLogged:        true,
+			wantReason:        ErrNotAuthorized.Error(),
+			wantAuthenticated: "false",
+		},
+		"not tailscale": {
+			remoteAddr:        "192.0.2.1:1234",
+			wantLogged:        true,
+			wantReason:        ErrNotTailscaleIP.Error(),
+			wantAuthenticated: "false",
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			logs := observe(m)
+			r := newRequest(tc.remoteAddr)
+			_, called, err := serve(t, m, r)
+			if err != nil || !called {
+				t.Fatalf("denied (err: %v), want passed on", err)
+			}
+			if got := getVar(r, "tailscale.authenticated"); got != tc.wantAuthenticated {
+				t.Errorf("tailscale.authenticated = %v, want %v", got, tc.wantAuthenticated)
+			}
+			if got := getVar(r, "tailscale.email"); got != tc.wantEmail {
+				t.Errorf("tailscale.email = %v, want %v", got, tc.wantEmail)
+			}
+
+			entries := logs.FilterMessage("request would be denied").All()
+			if got := len(entries) > 0; got != tc.wantLogged {
+				t.Fatalf("denial logged = %v, want %v", got, tc.wantLogged)
+			}
+			if !tc.wantLogged {
+				return
+			}
+			if e := entries[0]; e.Level != zapcore.InfoLevel {
+				t.Errorf("logged at %v, want info", e.Level)
+			}
+			if got := entries[0].ContextMap()["reason"]; got != tc.wantReason {
+				t.Errorf("reason = %v, want %q", got, tc.wantReason)
+			}
+		})
+	}
+}
+
+func TestLogTagDenial(t *testing.T) {
+	lc := newFakeClient()
+
+	cases := map[string]struct {
+		m          *Middleware
+		remoteAddr string
+		wantLogged bool
+		wantTags   string
+	}{
+		"tag mismatch": {
+			m:          &Middleware{AllowTags: []string{"tag:deploy"}},
+			remoteAddr: ciAddr,
+			wantLogged: true,
+			wantTags:   "[tag:ci]",
+		},
+		"untagged with require_tagged": {
+			m:          &Middleware{RequireTagged: true},
+			remoteAddr: aliceAddr,
+			wantLogged: true,
+			wantTags:   "[]",
+		},
+		"allowed": {
+			m:          &Middleware{AllowTags: []string{"tag:ci"}},
+			remoteAddr: ciAddr,
+		},
+		"no tag rules": {
+			m:          &Middleware{AllowUsers: []string{"alice@example.com"}},
+			remoteAddr: bobAddr,
+		},
+		"untagged with only allow_tags": {
+			m:          &Middleware{AllowTags: []string{"tag:ci"}},
+			remoteAddr: bobAddr,
+			wantLogged: true,
+			wantTags:   "[]",
+		},
+		"untagged with allow_users and allow_tags": {
+			m: &Middleware{
+				AllowUsers: []string{"alice@example.com"},
+				AllowTags:  []string{"tag:ci"},
+			},
+			remoteAddr: bobAddr,
+		},
+		"tagged with allow_users and allow_tags": {
+			m: &Middleware{
+				AllowUsers: []string{"alice@example.com"},
+				AllowTags:  []string{"tag:deploy"},
+			},
+			remoteAddr: ciAddr,
+			wantLogged: true,
+			wantTags:   "[tag:ci]",
+		},
+		"denied by deny_users": {
+			m: &Middleware{
+				DenyUsers: []string{"tagged-devices"},
+				AllowTags: []string{"tag:ci"},
+			},
+			remoteAddr: ciAddr,
+		},
+		"denied by require_cap": {
+			m: &Middleware{
+				RequireTagged: true,
+				RequireCaps:   []string{"example.com/cap/admin"},
+			},
+			remoteAddr: ciAddr,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			lc.provision(t, tc.m)
+			logs := observe(tc.m)
+
+			serve(t, tc.m, newRequest(tc.remoteAddr))
+
+			entries := logs.FilterMessage("node lacks required tags").All()
+			if got := len(entries) > 0; got != tc.wantLogged {
+				t.Fatalf("tag denial logged = %v, want %v", got, tc.wantLogged)
+			}
+			if !tc.wantLogged {
+				return
+			}
+			e := entries[0]
+			if e.Level != zapcore.WarnLevel {
+				t.Errorf("logged at %v, want warn", e.Level)
+			}
+			fields := e.ContextMap()
+			if got := fmt.Sprint(fields["tags"]); got != tc.wantTags {
+				t.Errorf("tags = %v, want %v", got, tc.wantTags)
+			}
+			if got, want := fmt.Sprint(fields["allow_tags"]), fmt.Sprint(tc.m.AllowTags); got != want {
+				t.Errorf("allow_tags = %v, want %v", got, want)
+			}
+			if got := fields["require_tagged"]; got != tc.m.RequireTagged {
+				t.Errorf("require_tagged = %v, want %v", got, tc.m.RequireTagged)
+			}
+			if _, ok := fields["login"]; ok {
+				t.Error("login logged on a tag denial")
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+// © 2021 Ilya Mateyko. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package tsid
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"tailscale.com/net/tsaddr"
+)
+
+// MatchTailscale is a Caddy request matcher that matches requests coming
+// from the Tailscale network. Unlike the tsid handler, it only checks the
+// remote address and doesn't identify the client.
+type MatchTailscale struct{}
+
+// CaddyModule returns the Caddy module information.
+func (MatchTailscale) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.matchers.tailscale",
+		New: func() caddy.Module { return new(MatchTailscale) },
+	}
+}
+
+// Match implements the caddyhttp.RequestMatcher interface.
+func (m MatchTailscale) Match(r *http.Request) bool {
+	match, _ := m.MatchWithError(r)
+	return match
+}
+
+// MatchWithError implements the caddyhttp.RequestMatcherWithError
+// interface.
+func (MatchTailscale) MatchWithError(r *http.Request) (bool, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false, nil
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return false, nil
+	}
+	return tsaddr.IsTailscaleIP(ip.Unmap()), nil
+}
+
+// UnmarshalCaddyfile implements the caddyfile.Unmarshaler interface.
+func (m *MatchTailscale) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+	}
+	return nil
+}
+
+// Interface guards.
+var (
+	_ caddyhttp.RequestMatcher          = (*MatchTailscale)(nil)
+	_ caddyhttp.RequestMatcherWithError = (*MatchTailscale)(nil)
+	_ caddyfile.Unmarshaler             = (*MatchTailscale)(nil)
+)
@@ -0,0 +1,60 @@
+// © 2021 Ilya Mateyko. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package tsid
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestMatchTailscale(t *testing.T) {
+	cases := map[string]bool{
+		"100.64.0.1:1234":          true,
+		"[fd7a:115c:a1e0::1]:1234": true,
+		"[::ffff:100.64.0.1]:1234": true,
+		"192.0.2.1:1234":           false,
+		"[::ffff:192.0.2.1]:1234":  false,
+		"127.0.0.1:1234":           false,
+		"invalid":                  false,
+	}
+	for addr, want := range cases {
+		t.Run(addr, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			r.RemoteAddr = addr
+			match, err := MatchTailscale{}.MatchWithError(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if match != want {
+				t.Errorf("MatchWithError() = %v, want %v", match, want)
+			}
+			if got := (MatchTailscale{}).Match(r); got != want {
+				t.Errorf("Match() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestMatchTailscaleUnmarshalCaddyfile(t *testing.T) {
+	cases := map[string]struct {
+		in      string
+		wantErr bool
+	}{
+		"no arguments": {in: `tailscale`},
+		"arguments":    {in: `tailscale yes`, wantErr: true},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			var m MatchTailscale
+			err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tc.in))
+			if (err != nil) != tc.wantErr {
+				t.Errorf("got error %v, want error: %v", err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+// © 2021 Ilya Mateyko. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package tsid
+
+import (
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Request results reported by the tsid_requests_total metric.
+const (
+	resultAllowed             = "allowed"
+	resultDeniedNotTailscale  = "denied_not_tailscale"
+	resultDeniedNotAuthorized = "denied_not_authorized"
+	resultRateLimited         = "rate_limited"
+	resultError               = "error"
+)
+
+// Kinds of cache hits reported by the tsid_whois_cache_hits_total metric.
+const (
+	cacheHitPositive = "positive"
+	cacheHitNegative = "negative"
+)
+
+// metrics holds the Prometheus metrics of the handler.
+type metrics struct {
+	requests      *prometheus.CounterVec
+	whoisDuration prometheus.Histogram
+	cacheHits     *prometheus.CounterVec
+	cacheMisses   prometheus.Counter
+}
+
+// newMetrics registers the handler metrics with reg. Metrics that are
+// already registered, for example by another tsid handler, are reused.
+func newMetrics(reg prometheus.Registerer) (*metrics, error) {
+	requests, err := register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "tsid",
+		Name:      "requests_total",
+		Help:      "Number of requests handled by tsid, by result.",
+	}, []string{"result"}))
+	if err != nil {
+		return nil, err
+	}
+	whoisDuration, err := register(reg, prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "tsid",
+		Name:      "whois_duration_seconds",
+		Help:      "Duration of WhoIs lookups.",
+		Buckets:   prometheus.DefBuckets,
+	}))
+	if err != nil {
+		return nil, err
+	}
+	cacheHits, err := register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "tsid",
+		Name:      "whois_cache_hits_total",
+		Help:      "Number of WhoIs lookups answered from the cache, by kind (positive or negative).",
+	}, []string{"kind"}))
+	if err != nil {
+		return nil, err
+	}
+	cacheMisses, err := register(reg, prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "tsid",
+		Name:      "whois_cache_misses_total",
+		Help:      "Number of WhoIs lookups not answered from the cache.",
+	}))
+	if err != nil {
+		return nil, err
+	}
+	return &metrics{
+		requests:      requests,
+		whoisDuration: whoisDuration,
+		cacheHits:     cacheHits,
+		cacheMisses:   cacheMisses,
+	}, nil
+}
+
+// register registers c with reg, returning the existing collector if an
+// identical one is already registered.
+func register[T prometheus.Collector](reg prometheus.Registerer, c T) (T, error) {
+	if err := reg.Register(c); err != nil {
+		var are prometheus.AlreadyRegisteredError
+		if errors.As(err, &are) {
+			if existing, ok := are.ExistingCollector.(T); ok {
+				return existing, nil
+			}
+		}
+		return c, err
+	}
+	return c, nil
+}
@@ -0,0 +1,145 @@
+// © 2021 Ilya Mateyko. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package tsid
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// gather returns the value of each tsid_requests_total series in reg by
+// result, and the number of observed WhoIs lookups.
+func gather(t *testing.T, reg prometheus.Gatherer) (requests map[string]float64, lookups uint64) {
+	t.Helper()
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests = make(map[string]float64)
+	for _, mf := range families {
+		switch mf.GetName() {
+		case "tsid_requests_total":
+			for _, m := range mf.GetMetric() {
+				for _, l := range m.GetLabel() {
+					if l.GetName() == "result" {
+						requests[l.GetValue()] = m.GetCounter().GetValue()
+					}
+				}
+			}
+		case "tsid_whois_duration_seconds":
+			for _, m := range mf.GetMetric() {
+				lookups += m.GetHistogram().GetSampleCount()
+			}
+		}
+	}
+	return requests, lookups
+}
+
+func TestMetrics(t *testing.T) {
+	lc := newFakeClient()
+	ctx := newContext(t)
+	m := &Middleware{
+		AllowUsers: []string{"alice@example.com"},
+		Client:     lc,
+	}
+	if err := m.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, addr := range []string{aliceAddr, aliceAddr, bobAddr, "192.0.2.1:1234", "100.64.0.2:1234", "invalid"} {
+		serve(t, m, newRequest(addr))
+	}
+
+	requests, lookups := gather(t, ctx.GetMetricsRegistry())
+	want := map[string]float64{
+		resultAllowed:             2,
+		resultDeniedNotTailscale:  1,
+		resultDeniedNotAuthorized: 2,
+		resultError:               1,
+	}
+	for result, n := range want {
+		if got := requests[result]; got != n {
+			t.Errorf("tsid_requests_total{result=%q} = %v, want %v", result, got, n)
+		}
+	}
+	// alice is cached after the first request.
+	if lookups != 3 {
+		t.Errorf("tsid_whois_duration_seconds observed %d lookups, want 3", lookups)
+	}
+}
+
+func TestMetricsReload(t *testing.T) {
+	lc := newFakeClient()
+	ctx := newContext(t)
+
+	for range 2 {
+		m := &Middleware{Client: lc}
+		if err := m.Provision(ctx); err != nil {
+			t.Fatal(err)
+		}
+		serve(t, m, newRequest(aliceAddr))
+	}
+
+	requests, _ := gather(t, ctx.GetMetricsRegistry())
+	if got := requests[resultAllowed]; got != 2 {
+		t.Errorf("tsid_requests_total{result=%q} = %v, want 2", resultAllowed, got)
+	}
+}
+
+// gatherCache returns the value of each tsid_whois_cache_hits_total
+// series in reg by kind, and the value of tsid_whois_cache_misses_total.
+func gatherCache(t *testing.T, reg prometheus.Gatherer) (hits map[string]float64, misses float64) {
+	t.Helper()
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hits = make(map[string]float64)
+	for _, mf := range families {
+		switch mf.GetName() {
+		case "tsid_whois_cache_hits_total":
+			for _, m := range mf.GetMetric() {
+				for _, l := range m.GetLabel() {
+					if l.GetName() == "kind" {
+						hits[l.GetValue()] = m.GetCounter().GetValue()
+					}
+				}
+			}
+		case "tsid_whois_cache_misses_total":
+			for _, m := range mf.GetMetric() {
+				misses += m.GetCounter().GetValue()
+			}
+		}
+	}
+	return hits, misses
+}
+
+func TestCacheMetrics(t *testing.T) {
+	lc := newFakeClient()
+	ctx := newContext(t)
+	m := &Middleware{Client: lc}
+	if err := m.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Not Tailscale IPs are never looked up.
+	for _, addr := range []string{aliceAddr, aliceAddr, aliceAddr, bobAddr, "100.64.0.2:1234", "100.64.0.2:1234", "192.0.2.1:1234"} {
+		serve(t, m, newRequest(addr))
+	}
+
+	hits, misses := gatherCache(t, ctx.GetMetricsRegistry())
+	for kind, want := range map[string]float64{
+		cacheHitPositive: 2,
+		cacheHitNegative: 1,
+	} {
+		if got := hits[kind]; got != want {
+			t.Errorf("tsid_whois_cache_hits_total{kind=%q} = %v, want %v", kind, got, want)
+		}
+	}
+	if misses != 3 {
+		t.Errorf("tsid_whois_cache_misses_total = %v, want 3", misses)
+	}
+}
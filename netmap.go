@@ -0,0 +1,140 @@
+// © 2021 Ilya Mateyko. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package tsid
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"tailscale.com/client/local"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/ipn"
+	"tailscale.com/types/netmap"
+)
+
+// netmapRetryDelay is how long the netmap watcher waits before
+// reconnecting to tailscaled after an error.
+const netmapRetryDelay = 5 * time.Second
+
+// ipnBusWatcher is the part of the local.Client API used to watch netmap
+// changes.
+type ipnBusWatcher interface {
+	WatchIPNBus(ctx context.Context, mask ipn.NotifyWatchOpt) (*local.IPNBusWatcher, error)
+}
+
+// netmapWatcher keeps the identities of tailnet peers in memory, updated
+// from the netmaps that tailscaled sends over the IPN bus. Peer
+// capabilities are not part of the netmap, so the responses it returns
+// have no CapMap.
+type netmapWatcher struct {
+	logger *zap.Logger
+	cancel context.CancelFunc
+	done   chan struct{} // closed when the watch loop exits
+
+	mu    sync.RWMutex
+	peers map[netip.Addr]*apitype.WhoIsResponse // guarded by mu
+}
+
+// watchNetmap starts watching the netmap of lc until close is called.
+func watchNetmap(lc ipnBusWatcher, logger *zap.Logger) *netmapWatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &netmapWatcher{
+		logger: logger,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go w.run(ctx, lc)
+	return w
+}
+
+// run watches the IPN bus, reconnecting on errors, until ctx is canceled.
+func (w *netmapWatcher) run(ctx context.Context, lc ipnBusWatcher) {
+	defer close(w.done)
+	for {
+		err := w.watch(ctx, lc)
+		if ctx.Err() != nil {
+			return
+		}
+		w.logger.Warn("watching tailscaled netmap failed", zap.Error(err))
+		// Stale identities are worse than WhoIs lookups.
+		w.setPeers(nil)
+		select {
+		case <-time.After(netmapRetryDelay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// watch reads netmap updates from a single IPN bus connection.
+func (w *netmapWatcher) watch(ctx context.Context, lc ipnBusWatcher) error {
+	bus, err := lc.WatchIPNBus(ctx, ipn.NotifyInitialNetMap|ipn.NotifyNoPrivateKeys)
+	if err != nil {
+		return err
+	}
+	defer bus.Close()
+	for {
+		n, err := bus.Next()
+		if err != nil {
+			return err
+		}
+		if n.ErrMessage != nil {
+			return errors.New(*n.ErrMessage)
+		}
+		if n.NetMap != nil {
+			w.setPeers(peersByAddr(n.NetMap))
+		}
+	}
+}
+
+func (w *netmapWatcher) setPeers(peers map[netip.Addr]*apitype.WhoIsResponse) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.peers = peers
+}
+
+// lookup returns the identity of the peer with the address ip, if it's
+// in the current netmap.
+func (w *netmapWatcher) lookup(ip netip.Addr) (*apitype.WhoIsResponse, bool) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	whois, ok := w.peers[ip]
+	return whois, ok
+}
+
+// close stops the watcher and waits for it to exit.
+func (w *netmapWatcher) close() {
+	w.cancel()
+	<-w.done
+}
+
+// peersByAddr indexes the peers of nm by their Tailscale addresses.
+func peersByAddr(nm *netmap.NetworkMap) map[netip.Addr]*apitype.WhoIsResponse {
+	peers := make(map[netip.Addr]*apitype.WhoIsResponse)
+	for _, pv := range nm.Peers {
+		if !pv.Valid() {
+			continue
+		}
+		node := pv.AsStruct()
+		profile, ok := nm.UserProfiles[node.User]
+		if !ok || !profile.Valid() {
+			continue
+		}
+		whois := &apitype.WhoIsResponse{
+			Node:        node,
+			UserProfile: profile.AsStruct(),
+		}
+		for _, p := range node.Addresses {
+			if p.IsSingleIP() {
+				peers[p.Addr()] = whois
+			}
+		}
+	}
+	return peers
+}
@@ -0,0 +1,170 @@
+// © 2021 Ilya Mateyko. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package tsid
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"tailscale.com/ipn"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/netmap"
+)
+
+// carol is a peer that is only known from the netmap.
+const carolAddr = "100.64.0.9:1234"
+
+// testNetmap returns a netmap with carol and a peer without a user
+// profile.
+func testNetmap() *netmap.NetworkMap {
+	return &netmap.NetworkMap{
+		Peers: []tailcfg.NodeView{
+			(&tailcfg.Node{
+				ID:           1,
+				Name:         "tablet.example.ts.net.",
+				ComputedName: "tablet",
+				User:         45678,
+				Addresses: []netip.Prefix{
+					netip.MustParsePrefix("100.64.0.9/32"),
+					netip.MustParsePrefix("fd7a:115c:a1e0::9/128"),
+				},
+			}).View(),
+			(&tailcfg.Node{
+				ID:        2,
+				Name:      "orphan.example.ts.net.",
+				User:      99999,
+				Addresses: []netip.Prefix{netip.MustParsePrefix("100.64.0.10/32")},
+			}).View(),
+		},
+		UserProfiles: map[tailcfg.UserID]tailcfg.UserProfileView{
+			45678: (&tailcfg.UserProfile{
+				ID:          45678,
+				LoginName:   "carol@example.com",
+				DisplayName: "Carol",
+			}).View(),
+		},
+	}
+}
+
+func TestPeersByAddr(t *testing.T) {
+	peers := peersByAddr(testNetmap())
+	if len(peers) != 2 {
+		t.Fatalf("got %d addresses, want 2", len(peers))
+	}
+	for _, addr := range []string{"100.64.0.9", "fd7a:115c:a1e0::9"} {
+		whois, ok := peers[netip.MustParseAddr(addr)]
+		if !ok {
+			t.Errorf("%s not found", addr)
+			continue
+		}
+		if whois.UserProfile.LoginName != "carol@example.com" {
+			t.Errorf("%s: got login %q, want carol@example.com", addr, whois.UserProfile.LoginName)
+		}
+	}
+	if _, ok := peers[netip.MustParseAddr("100.64.0.10")]; ok {
+		t.Error("peer without a user profile included")
+	}
+}
+
+// waitFor waits until cond returns true.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWatchNetmap(t *testing.T) {
+	lc := newFakeClient()
+	notify := lc.serveIPNBus(t)
+	m := &Middleware{WatchNetmap: true}
+	lc.provision(t, m)
+	t.Cleanup(func() { m.Cleanup() })
+
+	notify <- ipn.Notify{NetMap: testNetmap()}
+	waitFor(t, func() bool {
+		_, ok := m.netmap.lookup(netip.MustParseAddr("100.64.0.9"))
+		return ok
+	})
+
+	r := newRequest(carolAddr)
+	if _, called, err := serve(t, m, r); err != nil || !called {
+		t.Fatalf("request denied: %v", err)
+	}
+	if got := getVar(r, "tailscale.email"); got != "carol@example.com" {
+		t.Errorf("tailscale.email = %v, want carol@example.com", got)
+	}
+	if got := getVar(r, "tailscale.identity_source"); got != "netmap" {
+		t.Errorf("tailscale.identity_source = %v, want netmap", got)
+	}
+	if got := lc.whoisCalls.Load(); got != 0 {
+		t.Errorf("WhoIs called %d times for a peer in the netmap, want 0", got)
+	}
+
+	// Peers missing from the netmap fall back to WhoIs.
+	r = newRequest(aliceAddr)
+	if _, called, err := serve(t, m, r); err != nil || !called {
+		t.Fatalf("request denied: %v", err)
+	}
+	if got := getVar(r, "tailscale.email"); got != "alice@example.com" {
+		t.Errorf("tailscale.email = %v, want alice@example.com", got)
+	}
+	if got := lc.whoisCalls.Load(); got != 1 {
+		t.Errorf("WhoIs called %d times for a peer missing from the netmap, want 1", got)
+	}
+}
+
+func TestNetmapWatcherClose(t *testing.T) {
+	cases := map[string]bool{
+		"connected": true,  // the watcher is reading from the bus
+		"retrying":  false, // the watcher is waiting to reconnect
+	}
+	for name, connected := range cases {
+		t.Run(name, func(t *testing.T) {
+			lc := newFakeClient()
+			var notify chan<- ipn.Notify
+			if connected {
+				notify = lc.serveIPNBus(t)
+			}
+			w := watchNetmap(lc, zap.NewNop())
+			if connected {
+				notify <- ipn.Notify{NetMap: testNetmap()}
+			}
+
+			closed := make(chan struct{})
+			go func() {
+				w.close()
+				close(closed)
+			}()
+			select {
+			case <-closed:
+			case <-time.After(time.Second):
+				t.Fatal("close didn't return")
+			}
+		})
+	}
+}
+
+func TestValidateWatchNetmap(t *testing.T) {
+	for _, m := range []*Middleware{
+		{WatchNetmap: true, RequireCaps: []string{"example.com/cap/admin"}},
+		{WatchNetmap: true, CapPlaceholders: []CapPlaceholder{{Capability: "example.com/cap/app", Field: "role"}}},
+	} {
+		m.Client = newFakeClient()
+		if err := m.Provision(newContext(t)); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Validate(); err == nil {
+			t.Errorf("%+v: got no error", m)
+		}
+		m.Cleanup()
+	}
+}
@@ -0,0 +1,80 @@
+// © 2021 Ilya Mateyko. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package tsid
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a set of token buckets, one per key, that each allow
+// limit requests per window with bursts of up to limit requests.
+type rateLimiter struct {
+	limit  int
+	window time.Duration
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket // guarded by mu
+	lastPrune time.Time          // guarded by mu
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{
+		limit:   limit,
+		window:  window,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// allow reports whether a request for key is allowed at now, taking a
+// token from its bucket if it is.
+func (l *rateLimiter) allow(key string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.prune(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.limit), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = min(float64(l.limit), b.tokens+now.Sub(b.last).Seconds()*l.rate())
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// rate returns how many tokens are added to a bucket per second.
+func (l *rateLimiter) rate() float64 {
+	return float64(l.limit) / l.window.Seconds()
+}
+
+// retryAfter returns how long it takes for a bucket to get a token.
+func (l *rateLimiter) retryAfter() time.Duration {
+	return l.window / time.Duration(l.limit)
+}
+
+// prune removes buckets that have been full for a while, at most once
+// per window. l.mu must be held.
+func (l *rateLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < l.window {
+		return
+	}
+	l.lastPrune = now
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= l.window {
+			delete(l.buckets, key)
+		}
+	}
+}
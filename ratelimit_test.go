@@ -0,0 +1,55 @@
+// © 2021 Ilya Mateyko. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package tsid
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(3, time.Minute)
+	now := time.Now()
+
+	for i := range 3 {
+		if !l.allow("n1", now) {
+			t.Fatalf("request %d denied within the burst", i+1)
+		}
+	}
+	if l.allow("n1", now) {
+		t.Error("request over the burst allowed")
+	}
+	if !l.allow("n2", now) {
+		t.Error("another key is limited")
+	}
+
+	// One token is added every 20 seconds.
+	if l.allow("n1", now.Add(10*time.Second)) {
+		t.Error("request allowed before a token was added")
+	}
+	if !l.allow("n1", now.Add(30*time.Second)) {
+		t.Error("request denied after a token was added")
+	}
+	if got, want := l.retryAfter(), 20*time.Second; got != want {
+		t.Errorf("retryAfter() = %v, want %v", got, want)
+	}
+}
+
+func TestRateLimiterPrune(t *testing.T) {
+	l := newRateLimiter(1, time.Minute)
+	now := time.Now()
+	l.allow("n1", now)
+	l.allow("n2", now.Add(45*time.Second))
+
+	l.allow("n3", now.Add(90*time.Second))
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.buckets["n1"]; ok {
+		t.Error("idle bucket not pruned")
+	}
+	if _, ok := l.buckets["n2"]; !ok {
+		t.Error("recently used bucket pruned")
+	}
+}
@@ -0,0 +1,53 @@
+// © 2021 Ilya Mateyko. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package tsid
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"tailscale.com/client/local"
+	"tailscale.com/client/tailscale/apitype"
+)
+
+const tracerName = "go.astrophena.name/tsid"
+
+// startWhoIsSpan starts a tsid.whois span as a child of the span in ctx.
+// If ctx has no recording span, for example because Caddy tracing isn't
+// enabled, it returns ctx and a nil span without doing anything.
+func startWhoIsSpan(ctx context.Context, ip netip.Addr) (context.Context, trace.Span) {
+	parent := trace.SpanFromContext(ctx)
+	if !parent.IsRecording() {
+		return ctx, nil
+	}
+	return parent.TracerProvider().Tracer(tracerName).Start(ctx, "tsid.whois",
+		trace.WithAttributes(attribute.String("tsid.remote_ip", ip.String())))
+}
+
+// endWhoIsSpan records the outcome of a WhoIs lookup on span and ends it.
+// It does nothing if span is nil.
+func endWhoIsSpan(span trace.Span, whois *apitype.WhoIsResponse, err error) {
+	if span == nil {
+		return
+	}
+	defer span.End()
+	switch {
+	case err == nil:
+		span.SetAttributes(
+			attribute.String("tsid.outcome", "found"),
+			attribute.String("tsid.login", loginName(whois)),
+		)
+	case errors.Is(err, local.ErrPeerNotFound):
+		span.SetAttributes(attribute.String("tsid.outcome", "not_found"))
+	default:
+		span.SetAttributes(attribute.String("tsid.outcome", "error"))
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
@@ -0,0 +1,120 @@
+// © 2021 Ilya Mateyko. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package tsid
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+func TestWhoIsSpan(t *testing.T) {
+	down := newFakeClient()
+	down.err = errTailscaledDown
+	noProfile := newFakeClient()
+	noProfile.peers[netip.MustParseAddr("100.64.0.6")] = &apitype.WhoIsResponse{
+		Node: &tailcfg.Node{Name: "node.example.ts.net."},
+	}
+
+	cases := map[string]struct {
+		lc          *fakeClient
+		remoteAddr  string
+		wantAttrs   map[attribute.Key]string
+		wantErrCode bool
+	}{
+		"found": {
+			lc:         newFakeClient(),
+			remoteAddr: aliceAddr,
+			wantAttrs: map[attribute.Key]string{
+				"tsid.remote_ip": "100.64.0.1",
+				"tsid.outcome":   "found",
+				"tsid.login":     "alice@example.com",
+			},
+		},
+		"without user profile": {
+			lc:         noProfile,
+			remoteAddr: "100.64.0.6:1234",
+			wantAttrs: map[attribute.Key]string{
+				"tsid.remote_ip": "100.64.0.6",
+				"tsid.outcome":   "found",
+				"tsid.login":     "",
+			},
+		},
+		"not found": {
+			lc:         newFakeClient(),
+			remoteAddr: "100.64.0.2:1234",
+			wantAttrs: map[attribute.Key]string{
+				"tsid.remote_ip": "100.64.0.2",
+				"tsid.outcome":   "not_found",
+			},
+		},
+		"error": {
+			lc:         down,
+			remoteAddr: aliceAddr,
+			wantAttrs: map[attribute.Key]string{
+				"tsid.remote_ip": "100.64.0.1",
+				"tsid.outcome":   "error",
+			},
+			wantErrCode: true,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			rec := tracetest.NewSpanRecorder()
+			tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+			m := &Middleware{}
+			tc.lc.provision(t, m)
+
+			r := newRequest(tc.remoteAddr)
+			ctx, parent := tp.Tracer("test").Start(r.Context(), "request")
+			r = r.WithContext(ctx)
+			serve(t, m, r)
+			parent.End()
+
+			var span sdktrace.ReadOnlySpan
+			for _, s := range rec.Ended() {
+				if s.Name() == "tsid.whois" {
+					span = s
+				}
+			}
+			if span == nil {
+				t.Fatal("no tsid.whois span")
+			}
+			if span.Parent().SpanID() != parent.SpanContext().SpanID() {
+				t.Error("tsid.whois isn't a child of the request span")
+			}
+			attrs := make(map[attribute.Key]string)
+			for _, kv := range span.Attributes() {
+				attrs[kv.Key] = kv.Value.Emit()
+			}
+			for k, want := range tc.wantAttrs {
+				if got := attrs[k]; got != want {
+					t.Errorf("%s = %q, want %q", k, got, want)
+				}
+			}
+			if got := span.Status().Code == codes.Error; got != tc.wantErrCode {
+				t.Errorf("error status = %v, want %v", got, tc.wantErrCode)
+			}
+		})
+	}
+}
+
+func TestWhoIsSpanNotTraced(t *testing.T) {
+	ctx, span := startWhoIsSpan(context.Background(), netip.MustParseAddrPort(aliceAddr).Addr())
+	if span != nil {
+		t.Error("span started without a recording parent")
+	}
+	if ctx != context.Background() {
+		t.Error("context changed without a recording parent")
+	}
+	endWhoIsSpan(nil, nil, nil)
+}
@@ -8,27 +8,50 @@
 package tsid
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"math"
 	"net"
 	"net/http"
+	"net/netip"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
-	"inet.af/netaddr"
-	"tailscale.com/client/tailscale"
+	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
+	"tailscale.com/client/local"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/net/tsaddr"
+	"tailscale.com/tailcfg"
 )
 
 func init() {
 	caddy.RegisterModule(&Middleware{})
+	caddy.RegisterModule(MatchTailscale{})
 	httpcaddyfile.RegisterHandlerDirective("tsid", parseCaddyfileHandler)
 }
 
 // CaddyModule returns the Caddy module information.
-func (Middleware) CaddyModule() caddy.ModuleInfo {
+func (*Middleware) CaddyModule() caddy.ModuleInfo {
 	return caddy.ModuleInfo{
 		ID:  "http.handlers.tsid",
 		New: func() caddy.Module { return &Middleware{} },
@@ -38,40 +61,2129 @@ func (Middleware) CaddyModule() caddy.ModuleInfo {
 // Middleware is a Caddy HTTP handler that allows requests only from
 // the Tailscale network and sets placeholders based on the Tailscale
 // node information.
-type Middleware struct{}
+type Middleware struct {
+	// PlaceholderPrefix is the prefix of the placeholders set by the
+	// handler, such as {http.vars.<prefix>.email}. Defaults to
+	// "tailscale".
+	PlaceholderPrefix string `json:"placeholder_prefix,omitempty"`
 
-// ServeHTTP implements the caddyhttp.MiddlewareHandler interface.
-func (Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
-	ipStr, _, err := net.SplitHostPort(r.RemoteAddr)
+	// Placeholders is a list of identity placeholders to set, without
+	// the prefix, such as "email" or "node.hostname". Others are not
+	// computed. Defaults to all of them except "tailnet", which needs a
+	// status request to tailscaled. The authenticated, funnel and
+	// capability placeholders are always set.
+	Placeholders []string `json:"placeholders,omitempty"`
+
+	// Socket is the path to the tailscaled socket. If empty, the client
+	// of the tsid app is shared with other handlers.
+	Socket string `json:"socket,omitempty"`
+
+	// AllowUsers is a list of login names that are allowed to access
+	// the site. Login names are compared case-insensitively. If no allow
+	// rule is configured, any user of the tailnet is allowed.
+	AllowUsers []string `json:"allow_users,omitempty"`
+
+	// AllowUsersFile is the path to a file with more login names to
+	// allow, one per line. Blank lines and comments starting with # are
+	// ignored. The file is reloaded when it changes; if reloading fails,
+	// the previous list is kept.
+	AllowUsersFile string `json:"allow_users_file,omitempty"`
+
+	// AllowDomains is a list of domains whose users are allowed to access
+	// the site, such as example.com for alice@example.com. Domains are
+	// compared case-insensitively. Like all allow rules, it's enough to
+	// match AllowDomains or any other of them.
+	AllowDomains []string `json:"allow_domains,omitempty"`
+
+	// AllowLoginRegex is a regular expression (in Go syntax) that login
+	// names of allowed users must match. It's not anchored automatically:
+	// use ^ and $ to match whole login names.
+	AllowLoginRegex string `json:"allow_login_regex,omitempty"`
+
+	// DenyUsers is a list of login names that are denied access to the
+	// site. Login names are compared case-insensitively. DenyUsers takes
+	// precedence over AllowUsers.
+	DenyUsers []string `json:"deny_users,omitempty"`
+
+	// AllowTags is a list of ACL tags (such as tag:ci). Nodes that have
+	// at least one of these tags are allowed to access the site, in
+	// addition to those allowed by the other allow rules. Tags can be
+	// path.Match patterns, such as tag:svc-*.
+	AllowTags []string `json:"allow_tags,omitempty"`
+
+	// RequireTagged allows only requests from tagged nodes, rejecting
+	// nodes of human users.
+	RequireTagged bool `json:"require_tagged,omitempty"`
+
+	// RequireUser allows only requests from nodes of human users,
+	// rejecting tagged nodes. It can't be combined with RequireTagged.
+	RequireUser bool `json:"require_user,omitempty"`
+
+	// RequireCaps is a list of peer capabilities (such as
+	// example.com/cap/admin) granted by the tailnet policy file. Like the
+	// other allow rules, requests that have been granted any of these
+	// capabilities are allowed.
+	RequireCaps []string `json:"require_caps,omitempty"`
+
+	// CapMinVersions maps capabilities from RequireCaps to the minimum
+	// value of the "version" field of their grants. A capability is only
+	// considered granted if at least one of its grants has this version
+	// or newer. Grants without a valid version are version 0.
+	CapMinVersions map[string]int `json:"cap_min_versions,omitempty"`
+
+	// ExcludeShared denies requests from nodes that were shared into the
+	// tailnet from other tailnets. Such nodes have Node.Sharer set in the
+	// WhoIs response.
+	ExcludeShared bool `json:"exclude_shared,omitempty"`
+
+	// AllowOS is a list of operating systems (such as linux or windows,
+	// as reported by nodes in Hostinfo.OS) compared case-insensitively.
+	// If not empty, requests from nodes with another or unknown operating
+	// system are denied. Unlike the allow rules, it's a requirement.
+	AllowOS []string `json:"allow_os,omitempty"`
+
+	// RequireIdentity denies requests from peers whose WhoIs response
+	// has an empty login name, which can happen with some custom control
+	// servers, so that handlers after tsid can rely on it being set.
+	RequireIdentity bool `json:"require_identity,omitempty"`
+
+	// RequireAuthorized denies requests from nodes that haven't been
+	// approved by a tailnet admin, as reported by Node.MachineAuthorized
+	// in the WhoIs response. It's meant for tailnets with device approval
+	// enabled.
+	RequireAuthorized bool `json:"require_authorized,omitempty"`
+
+	// RequireSelfHost denies requests whose Host isn't the MagicDNS name
+	// of this node (the fully qualified or the short one), as reported
+	// by tailscaled. It guards against requests for other names that
+	// resolve to the same host.
+	RequireSelfHost bool `json:"require_self_host,omitempty"`
+
+	// RequireMagicDNSHost denies requests whose Host isn't a fully
+	// qualified MagicDNS name in the tailnet of this node (such as
+	// server.example.ts.net), including IP addresses. Unlike
+	// RequireSelfHost it accepts the names of any node.
+	RequireMagicDNSHost bool `json:"require_magicdns_host,omitempty"`
+
+	// AcceptTailnets is a list of tailnet DNS names (for example,
+	// example.ts.net) that requesting nodes must belong to. A node's
+	// tailnet is taken from its MagicDNS name, so nodes shared from
+	// other tailnets keep the tailnet of their owner. Defaults to any
+	// tailnet.
+	AcceptTailnets []string `json:"accept_tailnets,omitempty"`
+
+	// MaxKeyExpiry, if set, denies requests from nodes whose key expires
+	// within this duration or has already expired, nudging users to
+	// re-authenticate. Nodes with key expiry disabled are allowed.
+	MaxKeyExpiry caddy.Duration `json:"max_key_expiry,omitempty"`
+
+	// MinNodeAge, if set, denies requests from nodes that were added to
+	// the tailnet less than this duration ago. Nodes with an unknown
+	// creation time are allowed unless DenyUnknownNodeAge is set.
+	MinNodeAge caddy.Duration `json:"min_node_age,omitempty"`
+
+	// DenyUnknownNodeAge denies requests from nodes with an unknown
+	// creation time when MinNodeAge is set.
+	DenyUnknownNodeAge bool `json:"deny_unknown_node_age,omitempty"`
+
+	// CapPlaceholders exposes fields of peer capability grants as
+	// placeholders.
+	CapPlaceholders []CapPlaceholder `json:"cap_placeholders,omitempty"`
+
+	// ForbiddenStatus is the HTTP status code returned for requests that
+	// are not allowed. Defaults to 403.
+	ForbiddenStatus int `json:"forbidden_status,omitempty"`
+
+	// DenyMessage, if set, is written as the response body for requests
+	// that are not allowed instead of returning an error to Caddy. It may
+	// contain placeholders.
+	DenyMessage string `json:"deny_message,omitempty"`
+
+	// DenyAction controls how requests that are not allowed are denied:
+	// "respond" (the default) responds with ForbiddenStatus, "abort"
+	// closes the connection without a response, so that scanners can't
+	// tell there is a web server.
+	DenyAction string `json:"deny_action,omitempty"`
+
+	// JSONErrors makes denied requests get a JSON response body such as
+	// {"error": "not_authorized", "reason": "..."} instead of going
+	// through Caddy's error handling. The error is "not_tailscale_ip" or
+	// "not_authorized". Can't be combined with DenyMessage.
+	JSONErrors bool `json:"json_errors,omitempty"`
+
+	// UnauthenticatedRedirect is a URL that browsers are redirected to
+	// when the request doesn't come from the Tailscale network, for
+	// example a page that explains how to join it. Other clients get
+	// ForbiddenStatus as usual. Supports placeholders.
+	UnauthenticatedRedirect string `json:"unauthenticated_redirect,omitempty"`
+
+	// RateLimit, if set, limits how many requests each node (identified
+	// by its stable ID) can make per RateLimitWindow. Requests over the
+	// limit get 429 Too Many Requests.
+	RateLimit int `json:"rate_limit,omitempty"`
+
+	// RateLimitWindow is the window of RateLimit. Defaults to 1 minute.
+	RateLimitWindow caddy.Duration `json:"rate_limit_window,omitempty"`
+
+	// CacheTTL is how long WhoIs responses are cached for each remote IP.
+	// Defaults to 30 seconds.
+	CacheTTL caddy.Duration `json:"cache_ttl,omitempty"`
+
+	// NegativeCacheTTL is how long to remember remote IPs that don't
+	// belong to any peer. Defaults to 5 seconds.
+	NegativeCacheTTL caddy.Duration `json:"negative_cache_ttl,omitempty"`
+
+	// CacheMaxEntries is how many remote IPs the WhoIs cache holds at
+	// most. Past that, the least recently used entries are evicted
+	// before they expire. Defaults to 4096.
+	CacheMaxEntries int `json:"cache_max_entries,omitempty"`
+
+	// CacheRevalidate makes cached WhoIs responses valid only for the
+	// client address (IP and port) they were looked up for, so every new
+	// connection is looked up again. This guarantees that an IP that was
+	// reassigned to another node isn't identified as the old one, at the
+	// cost of a WhoIs lookup per connection. It has no effect for
+	// requests from TrustedProxies, since only the client IP is known.
+	CacheRevalidate bool `json:"cache_revalidate,omitempty"`
+
+	// StatusCacheTTL is how long the status of tailscaled, used for the
+	// tailnet placeholder, RequireSelfHost and RequireMagicDNSHost, is
+	// cached. Defaults to 1 minute.
+	StatusCacheTTL caddy.Duration `json:"status_cache_ttl,omitempty"`
+
+	// WatchNetmap keeps the identities of all peers in memory, updated
+	// from netmap changes pushed by tailscaled, so most requests are
+	// identified without a WhoIs lookup. Unknown addresses still fall
+	// back to WhoIs. Can't be combined with RequireCaps or
+	// CapPlaceholders, because the netmap has no peer capabilities.
+	WatchNetmap bool `json:"watch_netmap,omitempty"`
+
+	// AllowFunnel allows requests that arrive from the public internet
+	// through Tailscale Funnel. They have no identity placeholders except
+	// for <prefix>.funnel, which is set to "true".
+	AllowFunnel bool `json:"allow_funnel,omitempty"`
+
+	// AllowIPs is a list of IP ranges (or single IPs) outside of the
+	// Tailscale network that are allowed to access the site, without
+	// identity placeholders.
+	AllowIPs []string `json:"allow_ips,omitempty"`
+
+	// IPFamilies narrows the accepted Tailscale addresses: "both" (the
+	// default), "ipv4" or "ipv6". Requests from Tailscale addresses of
+	// the other family are denied.
+	IPFamilies string `json:"ip_families,omitempty"`
+
+	// HealthPath is a path that always gets an empty 200 OK response,
+	// before any other checks, so that health checks of load balancers
+	// pass even when tailscaled is down.
+	HealthPath string `json:"health_path,omitempty"`
+
+	// ExemptPaths is a list of path patterns, with the same syntax as
+	// the path request matcher, that are exempt from the Tailscale
+	// requirement. Requests to these paths are passed on without identity
+	// placeholders.
+	ExemptPaths []string `json:"exempt_paths,omitempty"`
+
+	// TrustLoopback allows requests from loopback addresses, without
+	// identity placeholders. It's meant for local development. Funnel
+	// requests, which tailscaled proxies from loopback, are still denied
+	// unless AllowFunnel is set.
+	TrustLoopback bool `json:"trust_loopback,omitempty"`
+
+	// TrustedProxies is a list of IP ranges (or single IPs) of proxies in
+	// front of Caddy. For requests from these proxies, the client address
+	// is taken from the X-Forwarded-For header: it's the right-most
+	// address that isn't itself a trusted proxy. The header is ignored
+	// for other requests. Proxies that use the PROXY protocol don't need
+	// to be listed: Caddy's proxy_protocol listener wrapper already
+	// reports the client address from the PROXY header as the remote
+	// address.
+	TrustedProxies []string `json:"trusted_proxies,omitempty"`
+
+	// ClientIPHeaderProxies is a list of IP ranges (or single IPs) of
+	// proxies that resolve the Tailscale IP of the client themselves and
+	// pass it in the Tailscale-Client-IP header, which must hold a
+	// Tailscale IP. For their requests, the header takes precedence over
+	// TrustedProxies. These proxies must strip the header from incoming
+	// requests, since otherwise clients can set it to any Tailscale IP.
+	// The header is ignored for other requests, including ones from
+	// TrustedProxies.
+	ClientIPHeaderProxies []string `json:"client_ip_header_proxies,omitempty"`
+
+	// WhoIsTimeout limits how long a WhoIs lookup, or a status request
+	// to tailscaled, can take. Timeouts are handled according to OnError.
+	// Defaults to the whois_timeout of the tsid app, then to 5 seconds.
+	WhoIsTimeout caddy.Duration `json:"whois_timeout,omitempty"`
+
+	// StartupGrace is how long after provisioning failures to reach
+	// tailscaled return 503 Service Unavailable with Retry-After instead
+	// of 500, until tailscaled answers for the first time. This makes
+	// load balancers retry during a cold start. Defaults to 30 seconds.
+	StartupGrace caddy.Duration `json:"startup_grace,omitempty"`
+
+	// WhoIsAttempts is how many times a WhoIs lookup is tried when
+	// tailscaled can't be reached, for example while it restarts. Unknown
+	// peers are never retried. All attempts share WhoIsTimeout. Defaults
+	// to 3.
+	WhoIsAttempts int `json:"whois_attempts,omitempty"`
+
+	// WhoIsBackoff is the delay before the second WhoIs attempt. It
+	// doubles with each following attempt. Defaults to 100 milliseconds.
+	WhoIsBackoff caddy.Duration `json:"whois_backoff,omitempty"`
+
+	// EmailLowercase lowercases the login name of the user in
+	// placeholders and headers. Display names are left as is.
+	EmailLowercase bool `json:"email_lowercase,omitempty"`
+
+	// HeadersUp enables passing the identity of the user upstream in
+	// request headers. By default, incoming headers with the same names
+	// are removed first (see StripHeaders), so clients can't spoof them.
+	HeadersUp bool `json:"headers_up,omitempty"`
+
+	// HeaderHMACSecret, if set, makes HeadersUp also pass an
+	// X-Tailscale-Signature header, so upstreams can check that the
+	// identity headers come from tsid. It's the hex-encoded HMAC-SHA256,
+	// keyed by the secret, of the values of UserHeader and NameHeader
+	// joined by a newline.
+	HeaderHMACSecret string `json:"header_hmac_secret,omitempty"`
+
+	// UserHeader is the request header that holds the login name of the
+	// user when HeadersUp is enabled. Defaults to X-Tailscale-User.
+	UserHeader string `json:"user_header,omitempty"`
+
+	// NameHeader is the request header that holds the display name of
+	// the user when HeadersUp is enabled. Defaults to X-Tailscale-Name.
+	NameHeader string `json:"name_header,omitempty"`
+
+	// SetHeaders maps names of request headers passed upstream to values
+	// with placeholders, such as {http.vars.tailscale.email}, expanded
+	// for identified requests. Headers whose value expands to an empty
+	// string are not set.
+	SetHeaders map[string]string `json:"set_headers,omitempty"`
+
+	// StripHeaders is a list of request headers that are removed from all
+	// incoming requests before anything else, so clients can't spoof
+	// them. UserHeader, NameHeader, X-Tailscale-Signature and the headers
+	// from SetHeaders are always removed, in addition to these.
+	StripHeaders []string `json:"strip_headers,omitempty"`
+
+	// RemoteUser enables setting the Remote-User response header to the
+	// login name of the user, so tsid can be used as a forward_auth
+	// target.
+	RemoteUser bool `json:"remote_user,omitempty"`
+
+	// RemoteEmail additionally sets the Remote-Email response header when
+	// RemoteUser is enabled.
+	RemoteEmail bool `json:"remote_email,omitempty"`
+
+	// OnError controls what happens when tailscaled can't be reached or
+	// fails to answer: "deny" (the default) fails the request, "allow"
+	// passes it on without identity placeholders. Requests from unknown
+	// peers are denied either way.
+	OnError string `json:"on_error,omitempty"`
+
+	// Enforce controls whether the handler checks requests at all: "on"
+	// (the default) or "off". With "off", every request is passed on,
+	// and placeholders and the WhoIs response set by an earlier tsid
+	// handler are cleared, so they look like an unidentified request.
+	// This allows to make a subroute public.
+	Enforce string `json:"enforce,omitempty"`
+
+	// Audit logs requests that would be denied at the info level, with
+	// the reason, and passes them on instead. Placeholders are set as
+	// usual when the peer could be identified. This allows to try out
+	// access rules before enforcing them.
+	Audit bool `json:"audit,omitempty"`
+
+	// ControlServer is the kind of control server of the tailnet:
+	// "tailscale" (the default) or "headscale". Headscale doesn't report
+	// some fields, so with "headscale" the name placeholder falls back to
+	// the login name and the tailnet placeholder to the domain of the
+	// node's MagicDNS name.
+	ControlServer string `json:"control_server,omitempty"`
+
+	// Client, if set, is used instead of connecting to tailscaled, for
+	// example to test configurations with tsidtest.Client. It can't be
+	// set from JSON.
+	Client LocalClient `json:"-"`
+
+	lc            LocalClient
+	ownClient     bool // whether lc was loaded for Socket
+	cache         *whoisCache
+	netmap        *netmapWatcher
+	limiter       *rateLimiter
+	metrics       *metrics
+	logger        *zap.Logger
+	proxies       []netip.Prefix
+	headerProxies []netip.Prefix // from ClientIPHeaderProxies
+	allowIPs      []netip.Prefix
+	exemptPaths   caddyhttp.MatchPath
+	stripHeaders  []string // StripHeaders and the headers set by the handler
+	allowUsers    map[string]bool
+	allowDomains  map[string]bool
+	loginRegex    *regexp.Regexp
+	denyUsers     map[string]bool
+	usersFile     *usersFile
+	tailnets      map[string]bool
+	allowOS       map[string]bool
+
+	started time.Time   // when the handler was provisioned
+	ready   atomic.Bool // whether tailscaled has answered
+
+	// ctx is canceled by Cleanup to abort in-flight tailscaled requests.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	statusGroup   singleflight.Group // coalesces status requests
+	mu            sync.Mutex
+	status        *ipnstate.Status // guarded by mu
+	statusExpires time.Time        // guarded by mu
+}
+
+// CapPlaceholder sets the <prefix>.<field> placeholder to the value of a
+// field of a peer capability grant. For example, with the grant
+// {"role": "editor"} and the field "role", {http.vars.tailscale.role} is
+// set to "editor". If the capability is granted multiple times, the values
+// are joined by commas.
+type CapPlaceholder struct {
+	// Capability is the name of the peer capability, such as
+	// example.com/cap/app.
+	Capability string `json:"capability"`
+
+	// Field is the name of the grant field and of the placeholder.
+	Field string `json:"field"`
+}
+
+// LocalClient is the subset of the local.Client API used by the handler.
+// It's implemented by local.Client and tsidtest.Client.
+type LocalClient interface {
+	WhoIser
+	StatusWithoutPeers(ctx context.Context) (*ipnstate.Status, error)
+	WatchIPNBus(ctx context.Context, mask ipn.NotifyWatchOpt) (*local.IPNBusWatcher, error)
+}
+
+// Provision implements the caddy.Provisioner interface.
+func (m *Middleware) Provision(ctx caddy.Context) error {
+	if m.ForbiddenStatus == 0 {
+		m.ForbiddenStatus = http.StatusForbidden
+	}
+	if m.OnError == "" {
+		m.OnError = onErrorDeny
+	}
+	if m.Enforce == "" {
+		m.Enforce = enforceOn
+	}
+	if m.DenyAction == "" {
+		m.DenyAction = denyActionRespond
+	}
+	if m.ControlServer == "" {
+		m.ControlServer = controlServerTailscale
+	}
+	if m.IPFamilies == "" {
+		m.IPFamilies = ipFamiliesBoth
+	}
+
+	if m.CacheTTL == 0 {
+		m.CacheTTL = caddy.Duration(defaultCacheTTL)
+	}
+	if m.NegativeCacheTTL == 0 {
+		m.NegativeCacheTTL = caddy.Duration(defaultNegativeCacheTTL)
+	}
+	if m.CacheMaxEntries == 0 {
+		m.CacheMaxEntries = defaultCacheMaxEntries
+	}
+	if m.RateLimitWindow == 0 {
+		m.RateLimitWindow = caddy.Duration(defaultRateLimitWindow)
+	}
+	if m.StatusCacheTTL == 0 {
+		m.StatusCacheTTL = caddy.Duration(defaultStatusCacheTTL)
+	}
+	appModule, err := ctx.App("tsid")
 	if err != nil {
-		return caddyhttp.Error(http.StatusInternalServerError, err)
+		return err
+	}
+	app := appModule.(*App)
+	if m.WhoIsTimeout == 0 {
+		m.WhoIsTimeout = app.WhoIsTimeout
+	}
+	if m.WhoIsTimeout == 0 {
+		m.WhoIsTimeout = caddy.Duration(defaultWhoIsTimeout)
+	}
+	if m.StartupGrace == 0 {
+		m.StartupGrace = caddy.Duration(defaultStartupGrace)
+	}
+	if m.WhoIsAttempts == 0 {
+		m.WhoIsAttempts = defaultWhoIsAttempts
+	}
+	if m.WhoIsBackoff == 0 {
+		m.WhoIsBackoff = caddy.Duration(defaultWhoIsBackoff)
+	}
+
+	if m.PlaceholderPrefix == "" {
+		m.PlaceholderPrefix = "tailscale"
+	}
+
+	if m.UserHeader == "" {
+		m.UserHeader = "X-Tailscale-User"
+	}
+	if m.NameHeader == "" {
+		m.NameHeader = "X-Tailscale-Name"
+	}
+	m.stripHeaders = []string{m.UserHeader, m.NameHeader, signatureHeader}
+	for name := range m.SetHeaders {
+		m.stripHeaders = append(m.stripHeaders, name)
+	}
+	m.stripHeaders = append(m.stripHeaders, m.StripHeaders...)
+
+	if m.proxies, err = parsePrefixes(m.TrustedProxies); err != nil {
+		return fmt.Errorf("trusted_proxies: %w", err)
+	}
+	if m.headerProxies, err = parsePrefixes(m.ClientIPHeaderProxies); err != nil {
+		return fmt.Errorf("client_ip_header_proxies: %w", err)
+	}
+	if m.allowIPs, err = parsePrefixes(m.AllowIPs); err != nil {
+		return fmt.Errorf("allow_ips: %w", err)
+	}
+
+	m.exemptPaths = caddyhttp.MatchPath(m.ExemptPaths)
+	if err := m.exemptPaths.Provision(ctx); err != nil {
+		return fmt.Errorf("exempt_paths: %w", err)
+	}
+
+	m.logger = ctx.Logger()
+	m.started = time.Now()
+	m.ctx, m.cancel = context.WithCancel(ctx)
+
+	if m.metrics, err = newMetrics(ctx.GetMetricsRegistry()); err != nil {
+		return err
+	}
+
+	switch {
+	case m.Client != nil:
+		m.lc = m.Client
+	case m.Socket != "":
+		if m.lc, err = loadClient(m.Socket); err != nil {
+			return err
+		}
+		m.ownClient = true
+	default:
+		m.lc = app.lc
+	}
+	m.cache = newWhoisCache(time.Duration(m.CacheTTL), time.Duration(m.NegativeCacheTTL), m.CacheMaxEntries, m.CacheRevalidate)
+	registerCache(m.cache)
+	if m.RateLimit > 0 {
+		m.limiter = newRateLimiter(m.RateLimit, time.Duration(m.RateLimitWindow))
+	}
+	if m.WatchNetmap {
+		m.netmap = watchNetmap(m.lc, m.logger)
+	}
+	if m.AllowUsersFile != "" {
+		if m.usersFile, err = loadUsersFile(m.AllowUsersFile, m.logger); err != nil {
+			return fmt.Errorf("allow_users_file: %w", err)
+		}
+	}
+	if m.AllowLoginRegex != "" {
+		if m.loginRegex, err = regexp.Compile(m.AllowLoginRegex); err != nil {
+			return fmt.Errorf("allow_login_regex: %w", err)
+		}
+	}
+	m.allowUsers = loginSet(m.AllowUsers)
+	m.allowDomains = loginSet(m.AllowDomains)
+	m.denyUsers = loginSet(m.DenyUsers)
+	m.allowOS = loginSet(m.AllowOS)
+	m.tailnets = make(map[string]bool, len(m.AcceptTailnets))
+	for _, t := range m.AcceptTailnets {
+		m.tailnets[strings.ToLower(strings.TrimSuffix(t, "."))] = true
+	}
+	return nil
+}
+
+// Validate implements the caddy.Validator interface.
+func (m *Middleware) Validate() error {
+	if !placeholderPrefixRe.MatchString(m.PlaceholderPrefix) {
+		return fmt.Errorf("placeholder_prefix %q must consist of letters, digits, underscores and dashes", m.PlaceholderPrefix)
+	}
+	for _, name := range m.Placeholders {
+		if !slices.Contains(identityPlaceholders, name) {
+			return fmt.Errorf("unknown placeholder %q", name)
+		}
+	}
+	for capability := range m.CapMinVersions {
+		if !slices.Contains(m.RequireCaps, capability) {
+			return fmt.Errorf("cap_min_versions: capability %q is not in require_caps", capability)
+		}
+	}
+	if m.RequireUser && m.RequireTagged {
+		return errors.New("require_user and require_tagged are mutually exclusive")
+	}
+	if m.RequireUser && len(m.AllowTags) > 0 {
+		return errors.New("require_user and allow_tags are mutually exclusive")
+	}
+	for name, list := range map[string][]string{
+		"allow_users":   m.AllowUsers,
+		"allow_domains": m.AllowDomains,
+		"deny_users":    m.DenyUsers,
+		"allow_tags":    m.AllowTags,
+		"allow_os":      m.AllowOS,
+	} {
+		if slices.Contains(list, "") {
+			return fmt.Errorf("%s must not contain empty entries", name)
+		}
+	}
+	for _, tag := range m.AllowTags {
+		if _, err := path.Match(tag, ""); err != nil {
+			return fmt.Errorf("allow_tags: invalid pattern %q: %w", tag, err)
+		}
+	}
+	for name, d := range map[string]caddy.Duration{
+		"cache_ttl":          m.CacheTTL,
+		"negative_cache_ttl": m.NegativeCacheTTL,
+		"status_cache_ttl":   m.StatusCacheTTL,
+		"whois_timeout":      m.WhoIsTimeout,
+		"whois_backoff":      m.WhoIsBackoff,
+		"rate_limit_window":  m.RateLimitWindow,
+		"startup_grace":      m.StartupGrace,
+		"max_key_expiry":     m.MaxKeyExpiry,
+		"min_node_age":       m.MinNodeAge,
+	} {
+		if d < 0 {
+			return fmt.Errorf("%s must not be negative, got %v", name, time.Duration(d))
+		}
+	}
+	if m.CacheMaxEntries < 1 {
+		return fmt.Errorf("cache_max_entries must be at least 1, got %d", m.CacheMaxEntries)
+	}
+	if m.RateLimit < 0 {
+		return fmt.Errorf("rate_limit must not be negative, got %d", m.RateLimit)
 	}
+	if m.WhoIsAttempts < 1 {
+		return fmt.Errorf("whois_attempts must be at least 1, got %d", m.WhoIsAttempts)
+	}
+	if m.ForbiddenStatus < 400 || m.ForbiddenStatus > 599 {
+		return fmt.Errorf("forbidden_status must be a 4xx or 5xx status code, got %d", m.ForbiddenStatus)
+	}
+	if m.OnError != onErrorDeny && m.OnError != onErrorAllow {
+		return fmt.Errorf("on_error must be %q or %q, got %q", onErrorDeny, onErrorAllow, m.OnError)
+	}
+	if m.Enforce != enforceOn && m.Enforce != enforceOff {
+		return fmt.Errorf("enforce must be %q or %q, got %q", enforceOn, enforceOff, m.Enforce)
+	}
+	if m.ControlServer != controlServerTailscale && m.ControlServer != controlServerHeadscale {
+		return fmt.Errorf("control_server must be %q or %q, got %q", controlServerTailscale, controlServerHeadscale, m.ControlServer)
+	}
+	if m.IPFamilies != ipFamiliesBoth && m.IPFamilies != ipFamiliesIPv4 && m.IPFamilies != ipFamiliesIPv6 {
+		return fmt.Errorf("ip_families must be %q, %q or %q, got %q", ipFamiliesBoth, ipFamiliesIPv4, ipFamiliesIPv6, m.IPFamilies)
+	}
+	if m.DenyAction != denyActionRespond && m.DenyAction != denyActionAbort {
+		return fmt.Errorf("deny_action must be %q or %q, got %q", denyActionRespond, denyActionAbort, m.DenyAction)
+	}
+	if m.JSONErrors && m.DenyMessage != "" {
+		return errors.New("json_errors and deny_message are mutually exclusive")
+	}
+	if m.WatchNetmap && (len(m.RequireCaps) > 0 || len(m.CapPlaceholders) > 0) {
+		return errors.New("watch_netmap can't be combined with require_cap or cap_placeholder")
+	}
+	return nil
+}
 
-	ip, err := netaddr.ParseIP(ipStr)
+var placeholderPrefixRe = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Cleanup implements the caddy.CleanerUpper interface.
+func (m *Middleware) Cleanup() error {
+	if m.cancel != nil {
+		m.cancel()
+	}
+	if m.ownClient {
+		releaseClient(m.Socket)
+	}
+	if m.netmap != nil {
+		m.netmap.close()
+	}
+	if m.usersFile != nil {
+		m.usersFile.close()
+	}
+	if m.cache != nil {
+		unregisterCache(m.cache)
+		m.cache.clear()
+	}
+	return nil
+}
+
+const (
+	onErrorDeny  = "deny"
+	onErrorAllow = "allow"
+)
+
+const (
+	denyActionRespond = "respond"
+	denyActionAbort   = "abort"
+)
+
+const (
+	controlServerTailscale = "tailscale"
+	controlServerHeadscale = "headscale"
+)
+
+const (
+	ipFamiliesBoth = "both"
+	ipFamiliesIPv4 = "ipv4"
+	ipFamiliesIPv6 = "ipv6"
+)
+
+const (
+	enforceOn  = "on"
+	enforceOff = "off"
+)
+
+const (
+	defaultCacheTTL         = 30 * time.Second
+	defaultNegativeCacheTTL = 5 * time.Second
+	defaultCacheMaxEntries  = 4096
+	defaultWhoIsTimeout     = 5 * time.Second
+	defaultStatusCacheTTL   = time.Minute
+	defaultWhoIsAttempts    = 3
+	defaultWhoIsBackoff     = 100 * time.Millisecond
+	defaultRateLimitWindow  = time.Minute
+	defaultStartupGrace     = 30 * time.Second
+)
+
+// parsePrefixes parses IP ranges in CIDR notation or single IPs.
+func parsePrefixes(ss []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range ss {
+		p, err := parsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, p)
+	}
+	return prefixes, nil
+}
+
+// parsePrefix parses s as an IP range in CIDR notation or as a single IP.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if !strings.Contains(s, "/") {
+		ip, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return netip.PrefixFrom(ip, ip.BitLen()), nil
+	}
+	return netip.ParsePrefix(s)
+}
+
+// loginSet returns a set of lowercased login names or domains.
+func loginSet(logins []string) map[string]bool {
+	if len(logins) == 0 {
+		return nil
+	}
+	set := make(map[string]bool, len(logins))
+	for _, login := range logins {
+		set[strings.ToLower(login)] = true
+	}
+	return set
+}
+
+// socketEnvVars are the environment variables that can hold the
+// tailscaled socket path, in order of precedence.
+var socketEnvVars = []string{"TS_SOCKET", "TAILSCALE_SOCKET"}
+
+// socketPath returns the tailscaled socket path to use. An explicitly
+// configured path wins over the environment; an empty result makes
+// local.Client use the platform default.
+func socketPath(configured string) string {
+	if configured != "" {
+		return configured
+	}
+	for _, env := range socketEnvVars {
+		if path := os.Getenv(env); path != "" {
+			return path
+		}
+	}
+	return ""
+}
+
+// WhoIsCtxKey is the request context key under which the WhoIs response
+// for identified requests is stored. Use WhoIsFromContext to retrieve it.
+const WhoIsCtxKey caddy.CtxKey = "tsid_whois"
+
+// WhoIsFromContext returns the WhoIs response stored in ctx by the tsid
+// handler. It reports false if the request wasn't identified.
+func WhoIsFromContext(ctx context.Context) (*apitype.WhoIsResponse, bool) {
+	whois, ok := ctx.Value(WhoIsCtxKey).(*apitype.WhoIsResponse)
+	return whois, ok && whois != nil
+}
+
+var (
+	// ErrNotTailscaleIP means that the client isn't on the Tailscale
+	// network.
+	ErrNotTailscaleIP = errors.New("not a Tailscale IP")
+	// ErrNotAuthorized means that the client isn't a known peer or isn't
+	// allowed by the access rules.
+	ErrNotAuthorized = errors.New("not authorized")
+
+	errWrongHost     = errors.New("host doesn't match this node")
+	errWrongIPFamily = errors.New("IP family not allowed")
+	errRateLimited   = errors.New("rate limit exceeded")
+)
+
+// ServeHTTP implements the caddyhttp.MiddlewareHandler interface.
+func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	if m.HealthPath != "" && r.URL.Path == m.HealthPath {
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+
+	for _, h := range m.stripHeaders {
+		r.Header.Del(h)
+	}
+
+	if m.Enforce == enforceOff {
+		m.clearVars(r)
+		r = r.WithContext(context.WithValue(r.Context(), WhoIsCtxKey, (*apitype.WhoIsResponse)(nil)))
+		return m.bypass(w, r, next, "enforcement disabled")
+	}
+
+	if len(m.exemptPaths) > 0 && m.exemptPaths.Match(r) {
+		return m.bypass(w, r, next, "exempt path", zap.String("path", r.URL.Path))
+	}
+
+	ip, addr, err := m.clientAddr(r)
 	if err != nil {
-		return caddyhttp.Error(http.StatusInternalServerError, err)
+		m.metrics.requests.WithLabelValues(resultError).Inc()
+		return err
+	}
+
+	fields := []zap.Field{zap.Stringer("remote_ip", ip)}
+
+	if m.AllowFunnel && isFunnel(r) {
+		m.setVar(r, "funnel", "true")
+		return m.bypass(w, r, next, "funnel request allowed", fields...)
 	}
 
 	if !tsaddr.IsTailscaleIP(ip) {
-		return caddyhttp.Error(http.StatusForbidden, errors.New("not a Tailscale IP"))
+		if containsIP(m.allowIPs, ip) {
+			return m.bypass(w, r, next, "allowed IP", fields...)
+		}
+		if m.TrustLoopback && ip.IsLoopback() && !isFunnel(r) {
+			return m.bypass(w, r, next, "loopback request allowed", fields...)
+		}
+		return m.deny(w, r, next, ErrNotTailscaleIP, fields...)
+	}
+	if !m.allowedFamily(ip) {
+		return m.deny(w, r, next, errWrongIPFamily, fields...)
+	}
+
+	if m.RequireSelfHost {
+		ok, err := m.selfHost(r.Context(), r.Host)
+		if err != nil {
+			return m.unavailable(w, r, next, err, fields...)
+		}
+		if !ok {
+			return m.deny(w, r, next, errWrongHost, fields...)
+		}
+	}
+	if m.RequireMagicDNSHost {
+		ok, err := m.magicDNSHost(r.Context(), r.Host)
+		if err != nil {
+			return m.unavailable(w, r, next, err, fields...)
+		}
+		if !ok {
+			return m.deny(w, r, next, errWrongHost, fields...)
+		}
 	}
 
-	whois, err := tailscale.WhoIs(r.Context(), r.RemoteAddr)
+	whois, source, latency, err := m.whois(r.Context(), ip, addr)
+	m.setVar(r, "identity_source", source)
+	fields = append(fields, zap.Duration("whois_latency", latency))
+	if errors.Is(err, local.ErrPeerNotFound) {
+		return m.deny(w, r, next, ErrNotAuthorized, fields...)
+	}
 	if err != nil {
-		if strings.Contains(err.Error(), "no match for IP:port") {
-			return caddyhttp.Error(http.StatusForbidden, errors.New("not authorized"))
+		return m.unavailable(w, r, next, err, fields...)
+	}
+
+	id := newIdentity(whois)
+	fields = append(fields, zap.String("login", id.Login))
+	if ok, byTags := m.authorized(whois); !ok {
+		if byTags {
+			m.logTagDenial(ip, whois)
+		}
+		if !m.Audit {
+			return m.deny(w, r, next, ErrNotAuthorized, fields...)
 		}
-		return caddyhttp.Error(http.StatusInternalServerError, err)
+		m.logger.Info("request would be denied", append(fields, zap.String("reason", ErrNotAuthorized.Error()))...)
+	}
+
+	if m.limiter != nil && id.NodeID != "" && !m.limiter.allow(id.NodeID, time.Now()) {
+		m.metrics.requests.WithLabelValues(resultRateLimited).Inc()
+		m.logger.Debug("request rate limited", fields...)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(m.limiter.retryAfter().Seconds()))))
+		return caddyhttp.Error(http.StatusTooManyRequests, errRateLimited)
+	}
+
+	var tailnet string
+	if m.wantsPlaceholder("tailnet") {
+		if tailnet, err = m.tailnetName(r.Context()); err != nil {
+			return m.unavailable(w, r, next, err, fields...)
+		}
+		if tailnet == "" && m.ControlServer == controlServerHeadscale {
+			tailnet = nodeTailnet(whois.Node)
+		}
+	}
+
+	login := id.Login
+	if m.EmailLowercase {
+		login = strings.ToLower(login)
+	}
+	displayName := id.DisplayName
+	if displayName == "" && m.ControlServer == controlServerHeadscale {
+		displayName = id.Login
+	}
+
+	m.setVar(r, "authenticated", "true")
+	m.setIdentityVar(r, "name", displayName)
+	m.setIdentityVar(r, "email", login)
+	m.setIdentityVar(r, "email_domain", loginDomain(login))
+	m.setIdentityVar(r, "principal", principal(whois.Node, login))
+	m.setIdentityVar(r, "profile_pic", id.ProfilePicURL)
+	m.setIdentityVar(r, "user_id", id.UserID)
+	caps := capNames(whois.CapMap)
+	m.setIdentityVar(r, "caps", strings.Join(caps, ","))
+	m.setIdentityVar(r, "cap_count", strconv.Itoa(len(caps)))
+	m.setIdentityVar(r, "tailnet", tailnet)
+	m.setIdentityVar(r, "node.id", id.NodeID)
+	m.setIdentityVar(r, "node.hostname", id.NodeName)
+	m.setIdentityVar(r, "node.tags", strings.Join(id.Tags, ","))
+	m.setIdentityVar(r, "node.routes", nodeRoutes(whois.Node))
+	m.setIdentityVar(r, "node.is_exit_node", strconv.FormatBool(isExitNode(whois.Node)))
+	goos, osVersion := nodeOS(whois.Node)
+	m.setIdentityVar(r, "node.os", goos)
+	m.setIdentityVar(r, "node.os_version", osVersion)
+	m.setIdentityVar(r, "node.device_model", nodeDeviceModel(whois.Node))
+	m.setIdentityVar(r, "node.created", nodeCreated(whois.Node))
+	m.setIdentityVar(r, "node.last_seen", nodeLastSeen(whois.Node))
+	m.setIdentityVar(r, "node.online", nodeOnline(whois.Node))
+	addr4, addr6 := nodeAddrs(whois.Node)
+	m.setIdentityVar(r, "node.addr", addr4)
+	m.setIdentityVar(r, "node.addr6", addr6)
+	for _, cp := range m.CapPlaceholders {
+		val, err := capField(whois.CapMap, cp.Capability, cp.Field)
+		if err != nil {
+			m.logger.Debug("skipping malformed capability grant", append(fields, zap.String("capability", cp.Capability), zap.Error(err))...)
+			continue
+		}
+		m.setVar(r, cp.Field, val)
+	}
+
+	if m.HeadersUp {
+		r.Header.Set(m.UserHeader, login)
+		r.Header.Set(m.NameHeader, displayName)
+		if m.HeaderHMACSecret != "" {
+			r.Header.Set(signatureHeader, signHeaders(m.HeaderHMACSecret, login, displayName))
+		}
+	}
+	if len(m.SetHeaders) > 0 {
+		for name, value := range m.SetHeaders {
+			if v := replace(r, value); v != "" {
+				r.Header.Set(name, v)
+			}
+		}
+	}
+	if m.RemoteUser {
+		w.Header().Set("Remote-User", login)
+		if m.RemoteEmail {
+			w.Header().Set("Remote-Email", login)
+		}
+	}
+
+	if extra, ok := r.Context().Value(caddyhttp.ExtraLogFieldsCtxKey).(*caddyhttp.ExtraLogFields); ok {
+		extra.Add(zap.String("tailscale_login", login))
+		extra.Add(zap.String("tailscale_node", id.NodeName))
 	}
 
-	caddyhttp.SetVar(r.Context(), "tailscale.name", whois.UserProfile.DisplayName)
-	caddyhttp.SetVar(r.Context(), "tailscale.email", whois.UserProfile.LoginName)
+	m.metrics.requests.WithLabelValues(resultAllowed).Inc()
+	m.logger.Debug("request allowed", fields...)
+
+	r = r.WithContext(context.WithValue(r.Context(), WhoIsCtxKey, whois))
 
 	return next.ServeHTTP(w, r)
 }
 
+// clientAddr returns the IP address of the client that made r and the
+// address to look up with WhoIs. If r comes from one of
+// ClientIPHeaderProxies, the client address is taken from the
+// Tailscale-Client-IP header. Otherwise, if r comes from a trusted proxy,
+// it's taken from the X-Forwarded-For header.
+func (m *Middleware) clientAddr(r *http.Request) (ip netip.Addr, addr string, err error) {
+	ip, addr, err = parseRemoteAddr(r.RemoteAddr)
+	if err != nil {
+		return ip, "", caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+
+	if s := r.Header.Get(clientIPHeader); s != "" && containsIP(m.headerProxies, ip) {
+		cip, err := netip.ParseAddr(strings.TrimSpace(s))
+		if err != nil {
+			return ip, "", caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("invalid %s address %q: %w", clientIPHeader, s, err))
+		}
+		cip = cip.Unmap()
+		if !tsaddr.IsTailscaleIP(cip) {
+			return ip, "", caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("%s address %v is not a Tailscale IP", clientIPHeader, cip))
+		}
+		return cip, cip.String(), nil
+	}
+
+	if !m.trustedProxy(ip) {
+		return ip, addr, nil
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		s := strings.TrimSpace(forwarded[i])
+		if s == "" {
+			continue
+		}
+		fip, err := netip.ParseAddr(s)
+		if err != nil {
+			return ip, "", caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("invalid X-Forwarded-For address %q: %w", s, err))
+		}
+		ip = fip.Unmap()
+		if !m.trustedProxy(ip) {
+			break
+		}
+	}
+	return ip, ip.String(), nil
+}
+
+// clientIPHeader is set by ClientIPHeaderProxies that have already
+// resolved the Tailscale IP of the client.
+const clientIPHeader = "Tailscale-Client-IP"
+
+// signatureHeader holds the signature of the identity headers when
+// HeaderHMACSecret is set.
+const signatureHeader = "X-Tailscale-Signature"
+
+// signHeaders returns the hex-encoded HMAC-SHA256 of the login and name
+// header values, joined by a newline, keyed by secret.
+func signHeaders(secret, login, name string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	io.WriteString(mac, login+"\n"+name)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// funnelHeader is set by tailscaled on requests it proxies from Tailscale
+// Funnel.
+const funnelHeader = "Tailscale-Funnel-Request"
+
+// isFunnel reports whether r came through Tailscale Funnel. tailscaled
+// proxies Funnel requests from the same host, so the header is trusted
+// only on loopback connections.
+func isFunnel(r *http.Request) bool {
+	if r.Header.Get(funnelHeader) == "" {
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip, err := netip.ParseAddr(host)
+	return err == nil && ip.Unmap().IsLoopback()
+}
+
+// trustedProxy reports whether ip belongs to a trusted proxy.
+func (m *Middleware) trustedProxy(ip netip.Addr) bool {
+	return containsIP(m.proxies, ip)
+}
+
+// containsIP reports whether any of prefixes contains ip.
+func containsIP(prefixes []netip.Prefix, ip netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// whois identifies the client with the address ip (addr with port) from
+// the netmap, if it's watched, or by a cached WhoIs lookup. source is
+// where the identity came from: "netmap", "cache" or "live". latency is
+// the duration of the lookup, or zero if none was made. If the request is
+// traced, the lookup is recorded in a tsid.whois span.
+func (m *Middleware) whois(ctx context.Context, ip netip.Addr, addr string) (whois *apitype.WhoIsResponse, source string, latency time.Duration, err error) {
+	ctx, span := startWhoIsSpan(ctx, ip)
+	defer func() { endWhoIsSpan(span, whois, err) }()
+
+	if m.netmap != nil {
+		if whois, ok := m.netmap.lookup(ip); ok {
+			return whois, "netmap", 0, nil
+		}
+	}
+	whois, latency, cached, err := m.cache.get(ctx, ip, addr, func(ctx context.Context) (*apitype.WhoIsResponse, error) {
+		ctx, cancel := context.WithTimeout(ctx, time.Duration(m.WhoIsTimeout))
+		defer cancel()
+		defer context.AfterFunc(m.ctx, cancel)()
+		start := time.Now()
+		defer func() { m.metrics.whoisDuration.Observe(time.Since(start).Seconds()) }()
+		return m.whoisWithRetry(ctx, addr)
+	})
+	if !cached {
+		m.metrics.cacheMisses.Inc()
+		return whois, "live", latency, err
+	}
+	kind := cacheHitPositive
+	if errors.Is(err, local.ErrPeerNotFound) {
+		kind = cacheHitNegative
+	}
+	m.metrics.cacheHits.WithLabelValues(kind).Inc()
+	return whois, "cache", latency, err
+}
+
+// whoisWithRetry calls WhoIs for addr, retrying with exponential backoff
+// if tailscaled can't be reached, until WhoIsAttempts are made or ctx is
+// done.
+func (m *Middleware) whoisWithRetry(ctx context.Context, addr string) (*apitype.WhoIsResponse, error) {
+	backoff := time.Duration(m.WhoIsBackoff)
+	for attempt := 1; ; attempt++ {
+		whois, err := m.lc.WhoIs(ctx, addr)
+		if err == nil || errors.Is(err, local.ErrPeerNotFound) {
+			m.ready.Store(true)
+		}
+		if err == nil || attempt >= m.WhoIsAttempts || !connError(err) {
+			return whois, err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, err
+		}
+		backoff *= 2
+	}
+}
+
+// connError reports whether err is a failure to talk to tailscaled, as
+// opposed to an error returned by it.
+func connError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// identityPlaceholders are the names of the placeholders that are set
+// for identified requests, and can be chosen with Placeholders.
+var identityPlaceholders = []string{
+	"name", "email", "email_domain", "principal", "profile_pic", "user_id", "caps", "cap_count", "tailnet",
+	"node.id", "node.hostname", "node.tags", "node.routes", "node.is_exit_node", "node.os",
+	"node.os_version", "node.device_model", "node.created", "node.last_seen", "node.online", "node.addr", "node.addr6",
+}
+
+// wantsPlaceholder reports whether the identity placeholder name should
+// be set.
+func (m *Middleware) wantsPlaceholder(name string) bool {
+	if m.Placeholders == nil {
+		return name != "tailnet"
+	}
+	return slices.Contains(m.Placeholders, name)
+}
+
+// setIdentityVar sets the identity placeholder name for r, unless it's
+// not wanted.
+func (m *Middleware) setIdentityVar(r *http.Request, name, value string) {
+	if m.wantsPlaceholder(name) {
+		m.setVar(r, name, value)
+	}
+}
+
+// setVar sets the placeholders {http.vars.<prefix>.<name>} and
+// {<prefix>.<name>} for r.
+func (m *Middleware) setVar(r *http.Request, name, value string) {
+	key := m.PlaceholderPrefix + "." + name
+	caddyhttp.SetVar(r.Context(), key, value)
+	if repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		repl.Set(key, value)
+	}
+}
+
+// replace replaces the placeholders in s with the replacer of r. Without
+// a replacer, such as when the handler is used outside of a Caddy server,
+// s is returned as is.
+func replace(r *http.Request, s string) string {
+	repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		return s
+	}
+	return repl.ReplaceAll(s, "")
+}
+
+// clearVars removes all placeholders with the prefix of the handler from
+// r, such as those set by another tsid handler earlier in the chain.
+func (m *Middleware) clearVars(r *http.Request) {
+	vars, ok := r.Context().Value(caddyhttp.VarsCtxKey).(map[string]any)
+	if !ok {
+		return
+	}
+	repl, _ := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	for k := range vars {
+		if strings.HasPrefix(k, m.PlaceholderPrefix+".") {
+			delete(vars, k)
+			if repl != nil {
+				repl.Delete(k)
+			}
+		}
+	}
+}
+
+// bypass passes the request on without identifying the client.
+func (m *Middleware) bypass(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler, msg string, fields ...zap.Field) error {
+	m.setVar(r, "authenticated", "false")
+	m.setVar(r, "identity_source", "bypass")
+	m.metrics.requests.WithLabelValues(resultAllowed).Inc()
+	m.logger.Debug(msg, fields...)
+	return next.ServeHTTP(w, r)
+}
+
+// unavailable handles an error talking to tailscaled. By default the
+// request fails, with 503 Service Unavailable while the handler is
+// starting and 500 Internal Server Error after that, but with on_error
+// allow it's passed on without identity placeholders.
+func (m *Middleware) unavailable(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler, err error, fields ...zap.Field) error {
+	m.metrics.requests.WithLabelValues(resultError).Inc()
+	m.logger.Warn("tailscaled request failed", append(fields, zap.Error(err))...)
+	if m.OnError == onErrorAllow {
+		m.setVar(r, "authenticated", "false")
+		m.setVar(r, "identity_source", "bypass")
+		return next.ServeHTTP(w, r)
+	}
+	if m.starting() {
+		w.Header().Set("Retry-After", "1")
+		return caddyhttp.Error(http.StatusServiceUnavailable, err)
+	}
+	return caddyhttp.Error(http.StatusInternalServerError, err)
+}
+
+// starting reports whether tailscaled hasn't answered yet and the
+// startup grace period hasn't elapsed.
+func (m *Middleware) starting() bool {
+	return !m.ready.Load() && time.Since(m.started) < time.Duration(m.StartupGrace)
+}
+
+// deny rejects the request according to the configured deny action.
+// reason is passed to Caddy's error handling unless another response
+// is configured. In audit mode, the request is logged and passed on
+// instead.
+func (m *Middleware) deny(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler, reason error, fields ...zap.Field) error {
+	if m.Audit {
+		m.logger.Info("request would be denied", append(fields, zap.String("reason", reason.Error()))...)
+		return m.bypass(w, r, next, "audit: request passed on", fields...)
+	}
+	result := resultDeniedNotAuthorized
+	if reason == ErrNotTailscaleIP {
+		result = resultDeniedNotTailscale
+	}
+	m.metrics.requests.WithLabelValues(result).Inc()
+	m.logger.Debug("request denied", append(fields, zap.String("reason", reason.Error()))...)
+
+	if m.DenyAction == denyActionAbort {
+		// Like the abort option of static_response: net/http closes
+		// the connection without writing a response.
+		panic(http.ErrAbortHandler)
+	}
+	if reason == ErrNotTailscaleIP && m.UnauthenticatedRedirect != "" && acceptsHTML(r) {
+		http.Redirect(w, r, replace(r, m.UnauthenticatedRedirect), http.StatusFound)
+		return nil
+	}
+	if m.JSONErrors {
+		code := "not_authorized"
+		if reason == ErrNotTailscaleIP {
+			code = "not_tailscale_ip"
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(m.ForbiddenStatus)
+		return json.NewEncoder(w).Encode(map[string]string{
+			"error":  code,
+			"reason": reason.Error(),
+		})
+	}
+	if m.DenyMessage == "" {
+		return caddyhttp.Error(m.ForbiddenStatus, reason)
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(m.ForbiddenStatus)
+	_, err := io.WriteString(w, replace(r, m.DenyMessage))
+	return err
+}
+
+// allowedFamily reports whether the Tailscale address ip is of an
+// address family allowed by IPFamilies.
+func (m *Middleware) allowedFamily(ip netip.Addr) bool {
+	switch m.IPFamilies {
+	case ipFamiliesIPv4:
+		return ip.Is4()
+	case ipFamiliesIPv6:
+		return ip.Is6()
+	}
+	return true
+}
+
+// acceptsHTML reports whether r looks like it comes from a browser.
+func acceptsHTML(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// authorized reports whether the user or node identified by whois is
+// allowed to access the site:
+//
+//  1. Users from DenyUsers are rejected.
+//  2. If any allow rule (AllowUsers, AllowUsersFile, AllowDomains,
+//     AllowLoginRegex, AllowTags or RequireCaps) is configured, at least
+//     one of them must match.
+//  3. All requirements, such as RequireTagged or MaxKeyExpiry, must hold.
+//
+// If the request is denied, byTags reports whether AllowTags or
+// RequireTagged decided it.
+func (m *Middleware) authorized(whois *apitype.WhoIsResponse) (ok, byTags bool) {
+	login := strings.ToLower(loginName(whois))
+	if m.denyUsers[login] {
+		return false, false
+	}
+	tagged := whois.Node != nil && len(whois.Node.Tags) > 0
+	if m.hasAllowRules() && !m.allowed(whois, login) {
+		// Tagged nodes can only match AllowTags or RequireCaps, but
+		// users may have been expected to match any of the rules.
+		return false, len(m.AllowTags) > 0 && (tagged || !m.hasNonTagAllowRules())
+	}
+	if m.RequireIdentity && login == "" {
+		return false, false
+	}
+	if m.RequireTagged && !tagged {
+		return false, true
+	}
+	if m.RequireUser && (whois.Node == nil || len(whois.Node.Tags) > 0) {
+		return false, false
+	}
+	if m.ExcludeShared && (whois.Node == nil || whois.Node.Sharer != 0) {
+		return false, false
+	}
+	if len(m.allowOS) > 0 {
+		if goos, _ := nodeOS(whois.Node); !m.allowOS[strings.ToLower(goos)] {
+			return false, false
+		}
+	}
+	if m.RequireAuthorized && (whois.Node == nil || !whois.Node.MachineAuthorized) {
+		return false, false
+	}
+	if len(m.tailnets) > 0 && !m.tailnets[nodeTailnet(whois.Node)] {
+		return false, false
+	}
+	if m.MaxKeyExpiry > 0 && keyExpiresWithin(whois.Node, time.Duration(m.MaxKeyExpiry)) {
+		return false, false
+	}
+	if m.MinNodeAge > 0 && m.nodeTooNew(whois.Node) {
+		return false, false
+	}
+	return true, false
+}
+
+// hasAllowRules reports whether any allow rule is configured.
+func (m *Middleware) hasAllowRules() bool {
+	return len(m.AllowTags) > 0 || m.hasNonTagAllowRules()
+}
+
+// hasNonTagAllowRules reports whether any allow rule other than
+// AllowTags is configured.
+func (m *Middleware) hasNonTagAllowRules() bool {
+	return len(m.allowUsers) > 0 || m.usersFile != nil || len(m.allowDomains) > 0 || m.loginRegex != nil || len(m.RequireCaps) > 0
+}
+
+// allowed reports whether whois, with the lowercase login, matches any
+// of the allow rules.
+func (m *Middleware) allowed(whois *apitype.WhoIsResponse, login string) bool {
+	if m.allowUsers[login] || m.usersFile.contains(login) {
+		return true
+	}
+	if domain := loginDomain(login); domain != "" && m.allowDomains[domain] {
+		return true
+	}
+	if m.loginRegex != nil && m.loginRegex.MatchString(loginName(whois)) {
+		return true
+	}
+	return hasAnyTag(whois.Node, m.AllowTags) || m.hasAnyCap(whois.CapMap)
+}
+
+// hasAnyCap reports whether caps grants at least one of RequireCaps,
+// with a version of at least the one from CapMinVersions.
+func (m *Middleware) hasAnyCap(caps tailcfg.PeerCapMap) bool {
+	for _, c := range m.RequireCaps {
+		if !caps.HasCapability(tailcfg.PeerCapability(c)) {
+			continue
+		}
+		if minVersion, ok := m.CapMinVersions[c]; ok && capVersion(caps, c) < minVersion {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// loginDomain returns the part of login after the @, or an empty string
+// if login isn't an email address.
+func loginDomain(login string) string {
+	i := strings.LastIndexByte(login, '@')
+	if i < 0 {
+		return ""
+	}
+	return login[i+1:]
+}
+
+// keyExpiresWithin reports whether the key of n expires within d or has
+// already expired. A zero expiry means that key expiry is disabled.
+func keyExpiresWithin(n *tailcfg.Node, d time.Duration) bool {
+	if n == nil {
+		return true
+	}
+	if n.KeyExpiry.IsZero() {
+		return false
+	}
+	return time.Until(n.KeyExpiry) < d
+}
+
+// nodeTooNew reports whether n was created less than MinNodeAge ago. A
+// zero creation time is unknown and counts as too new only with
+// DenyUnknownNodeAge.
+func (m *Middleware) nodeTooNew(n *tailcfg.Node) bool {
+	if n == nil || n.Created.IsZero() {
+		return m.DenyUnknownNodeAge
+	}
+	return time.Since(n.Created) < time.Duration(m.MinNodeAge)
+}
+
+// logTagDenial logs the tags of the node identified by whois and the
+// required ones at the warn level, to help debug requests from tagged
+// nodes denied because of AllowTags or RequireTagged. The login isn't
+// logged, since the node may belong to a user.
+func (m *Middleware) logTagDenial(ip netip.Addr, whois *apitype.WhoIsResponse) {
+	var tags []string
+	if whois.Node != nil {
+		tags = whois.Node.Tags
+	}
+	m.logger.Warn("node lacks required tags",
+		zap.Stringer("remote_ip", ip),
+		zap.String("node", nodeHostname(whois.Node)),
+		zap.Strings("tags", tags),
+		zap.Strings("allow_tags", m.AllowTags),
+		zap.Bool("require_tagged", m.RequireTagged),
+	)
+}
+
+// hasAnyTag reports whether n has a tag that matches at least one of
+// patterns, as in path.Match. Patterns are validated by Validate.
+func hasAnyTag(n *tailcfg.Node, patterns []string) bool {
+	if n == nil {
+		return false
+	}
+	for _, tag := range n.Tags {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, tag); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// capField returns the values of field in all grants of capability in
+// cm, joined by commas. String values are used as is, other values are
+// formatted as JSON.
+func capField(cm tailcfg.PeerCapMap, capability, field string) (string, error) {
+	var vals []string
+	for _, raw := range cm[tailcfg.PeerCapability(capability)] {
+		var grant map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(raw), &grant); err != nil {
+			return "", err
+		}
+		v, ok := grant[field]
+		if !ok {
+			continue
+		}
+		var str string
+		if err := json.Unmarshal(v, &str); err == nil {
+			vals = append(vals, str)
+			continue
+		}
+		vals = append(vals, string(v))
+	}
+	return strings.Join(vals, ","), nil
+}
+
+// capNames returns the sorted names of the capabilities in cm.
+func capNames(cm tailcfg.PeerCapMap) []string {
+	names := make([]string, 0, len(cm))
+	for c := range cm {
+		names = append(names, string(c))
+	}
+	slices.Sort(names)
+	return names
+}
+
+// capVersion returns the highest "version" field in the grants of
+// capability in cm. Malformed grants and grants without a version count
+// as version 0.
+func capVersion(cm tailcfg.PeerCapMap, capability string) int {
+	var latest int
+	for _, raw := range cm[tailcfg.PeerCapability(capability)] {
+		var grant struct {
+			Version int `json:"version"`
+		}
+		if err := json.Unmarshal([]byte(raw), &grant); err != nil {
+			continue
+		}
+		latest = max(latest, grant.Version)
+	}
+	return latest
+}
+
+// loginName returns the login name of the user from whois, or an empty
+// string if the user is unknown.
+func loginName(whois *apitype.WhoIsResponse) string {
+	if whois.UserProfile == nil {
+		return ""
+	}
+	return whois.UserProfile.LoginName
+}
+
+// userID returns the decimal form of the stable ID of p, or an empty
+// string if the user is unknown.
+func userID(p *tailcfg.UserProfile) string {
+	if p == nil || p.ID == 0 {
+		return ""
+	}
+	return strconv.FormatInt(int64(p.ID), 10)
+}
+
+// nodeHostname returns the machine name of n, or an empty string if n
+// is nil.
+func nodeHostname(n *tailcfg.Node) string {
+	if n == nil {
+		return ""
+	}
+	if n.ComputedName != "" {
+		return n.ComputedName
+	}
+	return n.Name
+}
+
+// nodeTailnet returns the lowercase DNS name of the tailnet that n
+// belongs to, derived from its MagicDNS name, or an empty string if it
+// can't be determined.
+func nodeTailnet(n *tailcfg.Node) string {
+	if n == nil {
+		return ""
+	}
+	_, tailnet, ok := strings.Cut(strings.TrimSuffix(n.Name, "."), ".")
+	if !ok {
+		return ""
+	}
+	return strings.ToLower(tailnet)
+}
+
+// nodeDeviceModel returns the device model of n (for example, "iPhone14,2"),
+// as reported by the node itself.
+func nodeDeviceModel(n *tailcfg.Node) string {
+	if n == nil || !n.Hostinfo.Valid() {
+		return ""
+	}
+	return n.Hostinfo.DeviceModel()
+}
+
+// nodeRoutes returns the subnet routes that n serves as the primary
+// router for (Node.PrimaryRoutes), joined by commas. Routes that n
+// advertises but another router currently serves are not included.
+func nodeRoutes(n *tailcfg.Node) string {
+	if n == nil {
+		return ""
+	}
+	routes := make([]string, len(n.PrimaryRoutes))
+	for i, p := range n.PrimaryRoutes {
+		routes[i] = p.String()
+	}
+	return strings.Join(routes, ",")
+}
+
+// isExitNode reports whether n has a default route (0.0.0.0/0 or ::/0)
+// in Node.AllowedIPs or Node.PrimaryRoutes.
+func isExitNode(n *tailcfg.Node) bool {
+	if n == nil {
+		return false
+	}
+	for _, p := range slices.Concat(n.AllowedIPs, n.PrimaryRoutes) {
+		if p.Bits() == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// nodeOS returns the operating system of n and its version, as reported
+// by the node itself.
+func nodeOS(n *tailcfg.Node) (goos, version string) {
+	if n == nil || !n.Hostinfo.Valid() {
+		return "", ""
+	}
+	return n.Hostinfo.OS(), n.Hostinfo.OSVersion()
+}
+
+// principal returns the first ACL tag of n if it's a tagged node, or
+// login otherwise. Tagged nodes have no human user, so their login is
+// the shared "tagged-devices" pseudo-user.
+func principal(n *tailcfg.Node, login string) string {
+	if n != nil && len(n.Tags) > 0 {
+		return n.Tags[0]
+	}
+	return login
+}
+
+// nodeID returns the stable ID of n, or an empty string if n is nil.
+func nodeID(n *tailcfg.Node) string {
+	if n == nil {
+		return ""
+	}
+	return string(n.StableID)
+}
+
+// nodeAddrs returns the first Tailscale IPv4 and IPv6 addresses of n.
+// Either is empty if n has no address of that family.
+func nodeAddrs(n *tailcfg.Node) (addr4, addr6 string) {
+	if n == nil {
+		return "", ""
+	}
+	for _, p := range n.Addresses {
+		ip := p.Addr()
+		switch {
+		case addr4 == "" && tsaddr.IsTailscaleIPv4(ip):
+			addr4 = ip.String()
+		case addr6 == "" && tsaddr.TailscaleULARange().Contains(ip):
+			addr6 = ip.String()
+		}
+	}
+	return addr4, addr6
+}
+
+// nodeCreated returns when n was added to the tailnet in RFC 3339
+// format, or an empty string if it's unknown.
+func nodeCreated(n *tailcfg.Node) string {
+	if n == nil || n.Created.IsZero() {
+		return ""
+	}
+	return n.Created.Format(time.RFC3339)
+}
+
+// nodeLastSeen returns when n was last seen by the control plane in
+// RFC 3339 format, or an empty string if it's unknown. The control plane
+// doesn't report it for nodes that are currently online.
+func nodeLastSeen(n *tailcfg.Node) string {
+	if n == nil || n.LastSeen == nil {
+		return ""
+	}
+	return n.LastSeen.Format(time.RFC3339)
+}
+
+// nodeOnline returns "true" or "false" depending on whether the control
+// plane reports n as online, or "unknown" if it doesn't report it.
+func nodeOnline(n *tailcfg.Node) string {
+	if n == nil || n.Online == nil {
+		return "unknown"
+	}
+	return strconv.FormatBool(*n.Online)
+}
+
+// tailnetName returns the DNS name of the tailnet (for example,
+// example.ts.net).
+func (m *Middleware) tailnetName(ctx context.Context) (string, error) {
+	st, err := m.cachedStatus(ctx)
+	if err != nil {
+		return "", err
+	}
+	if st.CurrentTailnet != nil {
+		return st.CurrentTailnet.MagicDNSSuffix, nil
+	}
+	return st.MagicDNSSuffix, nil
+}
+
+// selfHost reports whether host, with an optional port, is the MagicDNS
+// name of this node, either fully qualified or short.
+func (m *Middleware) selfHost(ctx context.Context, host string) (bool, error) {
+	st, err := m.cachedStatus(ctx)
+	if err != nil {
+		return false, err
+	}
+	if st.Self == nil || st.Self.DNSName == "" {
+		return false, nil
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(host, ".")
+	fqdn := strings.TrimSuffix(st.Self.DNSName, ".")
+	short, _, _ := strings.Cut(fqdn, ".")
+	return strings.EqualFold(host, fqdn) || strings.EqualFold(host, short), nil
+}
+
+// magicDNSHost reports whether host, with an optional port, is a fully
+// qualified MagicDNS name in the tailnet of this node.
+func (m *Middleware) magicDNSHost(ctx context.Context, host string) (bool, error) {
+	suffix, err := m.tailnetName(ctx)
+	if err != nil {
+		return false, err
+	}
+	if suffix == "" {
+		return false, nil
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(host, ".")
+	n := len(host) - len(suffix) - 1
+	if n < 1 || host[n] != '.' || !strings.EqualFold(host[n+1:], suffix) {
+		return false, nil
+	}
+	return !strings.Contains(host[:n], "."), nil
+}
+
+// cachedStatus returns the status of tailscaled without peers. Status
+// is comparatively expensive, so it's cached for StatusCacheTTL, and
+// concurrent requests for it share a single one, limited by WhoIsTimeout.
+func (m *Middleware) cachedStatus(ctx context.Context) (*ipnstate.Status, error) {
+	m.mu.Lock()
+	st, expires := m.status, m.statusExpires
+	m.mu.Unlock()
+	if st != nil && time.Now().Before(expires) {
+		return st, nil
+	}
+
+	// Like WhoIs lookups in whoisCache.get, the shared request isn't
+	// canceled with the request that started it.
+	ch := m.statusGroup.DoChan("", func() (any, error) {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Duration(m.WhoIsTimeout))
+		defer cancel()
+		defer context.AfterFunc(m.ctx, cancel)()
+		st, err := m.lc.StatusWithoutPeers(ctx)
+		if err != nil {
+			return nil, err
+		}
+		m.ready.Store(true)
+		m.mu.Lock()
+		m.status = st
+		m.statusExpires = time.Now().Add(time.Duration(m.StatusCacheTTL))
+		m.mu.Unlock()
+		return st, nil
+	})
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.(*ipnstate.Status), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
 // UnmarshalCaddyfile implements the caddyfile.Unmarshaler interface.
-func (Middleware) UnmarshalCaddyfile(d *caddyfile.Dispenser) error { return nil }
+func (m *Middleware) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "placeholder_prefix":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.PlaceholderPrefix = d.Val()
+			case "placeholders":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				m.Placeholders = append(m.Placeholders, args...)
+			case "socket":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.Socket = d.Val()
+			case "allow_users":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				m.AllowUsers = append(m.AllowUsers, args...)
+			case "allow_users_file":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.AllowUsersFile = d.Val()
+			case "allow_domains":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				m.AllowDomains = append(m.AllowDomains, args...)
+			case "allow_login_regex":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.AllowLoginRegex = d.Val()
+			case "deny_users":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				m.DenyUsers = append(m.DenyUsers, args...)
+			case "allow_tags":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				m.AllowTags = append(m.AllowTags, args...)
+			case "require_tagged":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				m.RequireTagged = true
+			case "require_user":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				m.RequireUser = true
+			case "require_cap":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				capability := d.Val()
+				m.RequireCaps = append(m.RequireCaps, capability)
+				if d.NextArg() {
+					if d.Val() != "min_version" || !d.NextArg() {
+						return d.ArgErr()
+					}
+					minVersion, err := strconv.Atoi(d.Val())
+					if err != nil {
+						return d.Errf("invalid min_version %q: %v", d.Val(), err)
+					}
+					if m.CapMinVersions == nil {
+						m.CapMinVersions = make(map[string]int)
+					}
+					m.CapMinVersions[capability] = minVersion
+				}
+			case "exclude_shared":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				m.ExcludeShared = true
+			case "allow_os":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				m.AllowOS = append(m.AllowOS, args...)
+			case "require_identity":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				m.RequireIdentity = true
+			case "require_authorized":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				m.RequireAuthorized = true
+			case "require_self_host":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				m.RequireSelfHost = true
+			case "require_magicdns_host":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				m.RequireMagicDNSHost = true
+			case "accept_tailnets":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				m.AcceptTailnets = append(m.AcceptTailnets, args...)
+			case "max_key_expiry":
+				expiry, err := parseDuration(d)
+				if err != nil {
+					return err
+				}
+				m.MaxKeyExpiry = expiry
+			case "min_node_age":
+				age, err := parseDuration(d)
+				if err != nil {
+					return err
+				}
+				m.MinNodeAge = age
+				if d.NextArg() {
+					if d.Val() != "deny_unknown" {
+						return d.Errf("unknown min_node_age option %q", d.Val())
+					}
+					m.DenyUnknownNodeAge = true
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "cap_placeholder":
+				var cp CapPlaceholder
+				if !d.AllArgs(&cp.Capability, &cp.Field) {
+					return d.ArgErr()
+				}
+				m.CapPlaceholders = append(m.CapPlaceholders, cp)
+			case "forbidden_status":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				code, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid status code %q: %v", d.Val(), err)
+				}
+				m.ForbiddenStatus = code
+			case "deny_message":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.DenyMessage = d.Val()
+			case "deny_action":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.DenyAction = d.Val()
+			case "json_errors":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				m.JSONErrors = true
+			case "email_lowercase":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				m.EmailLowercase = true
+			case "headers_up":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				m.HeadersUp = true
+			case "header_hmac_secret":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.HeaderHMACSecret = d.Val()
+			case "user_header":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.UserHeader = d.Val()
+			case "name_header":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.NameHeader = d.Val()
+			case "set_header":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				name := d.Val()
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				if m.SetHeaders == nil {
+					m.SetHeaders = make(map[string]string)
+				}
+				m.SetHeaders[name] = d.Val()
+			case "strip_headers":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				m.StripHeaders = append(m.StripHeaders, args...)
+			case "remote_user_header":
+				m.RemoteUser = true
+				if d.NextArg() {
+					if d.Val() != "with_email" {
+						return d.Errf("unknown remote_user_header option %q", d.Val())
+					}
+					m.RemoteEmail = true
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "on_error":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.OnError = d.Val()
+			case "control_server":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.ControlServer = d.Val()
+			case "ip_families":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.IPFamilies = d.Val()
+			case "enforce":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.Enforce = d.Val()
+			case "audit":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				m.Audit = true
+			case "unauthenticated_redirect":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.UnauthenticatedRedirect = d.Val()
+			case "cache_max_entries":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				n, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid number of cache entries %q: %v", d.Val(), err)
+				}
+				m.CacheMaxEntries = n
+			case "cache_revalidate":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				m.CacheRevalidate = true
+			case "rate_limit":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				limit, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid rate limit %q: %v", d.Val(), err)
+				}
+				m.RateLimit = limit
+				if d.NextArg() {
+					window, err := caddy.ParseDuration(d.Val())
+					if err != nil {
+						return d.Errf("invalid duration %q: %v", d.Val(), err)
+					}
+					m.RateLimitWindow = caddy.Duration(window)
+				}
+			case "cache_ttl":
+				ttl, err := parseDuration(d)
+				if err != nil {
+					return err
+				}
+				m.CacheTTL = ttl
+			case "status_cache_ttl":
+				ttl, err := parseDuration(d)
+				if err != nil {
+					return err
+				}
+				m.StatusCacheTTL = ttl
+			case "watch_netmap":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				m.WatchNetmap = true
+			case "negative_cache_ttl":
+				ttl, err := parseDuration(d)
+				if err != nil {
+					return err
+				}
+				m.NegativeCacheTTL = ttl
+			case "allow_funnel":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				m.AllowFunnel = true
+			case "allow_ips":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				m.AllowIPs = append(m.AllowIPs, args...)
+			case "health_path":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.HealthPath = d.Val()
+			case "exempt_paths":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				m.ExemptPaths = append(m.ExemptPaths, args...)
+			case "trust_loopback":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				m.TrustLoopback = true
+			case "trusted_proxies":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				m.TrustedProxies = append(m.TrustedProxies, args...)
+			case "client_ip_header_proxies":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				m.ClientIPHeaderProxies = append(m.ClientIPHeaderProxies, args...)
+			case "startup_grace":
+				grace, err := parseDuration(d)
+				if err != nil {
+					return err
+				}
+				m.StartupGrace = grace
+			case "whois_attempts":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				attempts, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid number of attempts %q: %v", d.Val(), err)
+				}
+				m.WhoIsAttempts = attempts
+			case "whois_backoff":
+				backoff, err := parseDuration(d)
+				if err != nil {
+					return err
+				}
+				m.WhoIsBackoff = backoff
+			case "whois_timeout":
+				timeout, err := parseDuration(d)
+				if err != nil {
+					return err
+				}
+				m.WhoIsTimeout = timeout
+			default:
+				return d.Errf("unrecognized subdirective %q", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+// parseDuration parses the next argument of d as a duration.
+func parseDuration(d *caddyfile.Dispenser) (caddy.Duration, error) {
+	if !d.NextArg() {
+		return 0, d.ArgErr()
+	}
+	dur, err := caddy.ParseDuration(d.Val())
+	if err != nil {
+		return 0, d.Errf("invalid duration %q: %v", d.Val(), err)
+	}
+	return caddy.Duration(dur), nil
+}
 
 // parseCaddyfileHandler unmarshals tokens from h into a new middleware handler value.
 func parseCaddyfileHandler(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
@@ -82,6 +2194,10 @@ func parseCaddyfileHandler(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler,
 
 // Interface guards.
 var (
+	_ LocalClient                 = (*local.Client)(nil)
+	_ caddy.Provisioner           = (*Middleware)(nil)
+	_ caddy.Validator             = (*Middleware)(nil)
+	_ caddy.CleanerUpper          = (*Middleware)(nil)
 	_ caddyhttp.MiddlewareHandler = (*Middleware)(nil)
 	_ caddyfile.Unmarshaler       = (*Middleware)(nil)
 )
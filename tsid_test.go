@@ -0,0 +1,3967 @@
+// © 2021 Ilya Mateyko. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package tsid
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"tailscale.com/client/local"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+)
+
+func TestUnmarshalCaddyfile(t *testing.T) {
+	cases := map[string]struct {
+		in      string
+		want    *Middleware
+		wantErr bool
+	}{
+		"empty": {
+			in:   `tsid`,
+			want: &Middleware{},
+		},
+		"socket": {
+			in: `tsid {
+				socket /var/run/tailscale/tailscaled.sock
+			}`,
+			want: &Middleware{Socket: "/var/run/tailscale/tailscaled.sock"},
+		},
+		"socket without path": {
+			in: `tsid {
+				socket
+			}`,
+			wantErr: true,
+		},
+		"allow_users": {
+			in: `tsid {
+				allow_users alice@example.com bob@example.org
+				allow_users carol@example.net
+			}`,
+			want: &Middleware{AllowUsers: []string{"alice@example.com", "bob@example.org", "carol@example.net"}},
+		},
+		"deny_users": {
+			in: `tsid {
+				deny_users bob@example.org
+			}`,
+			want: &Middleware{DenyUsers: []string{"bob@example.org"}},
+		},
+		"allow_tags": {
+			in: `tsid {
+				allow_tags tag:ci tag:deploy
+			}`,
+			want: &Middleware{AllowTags: []string{"tag:ci", "tag:deploy"}},
+		},
+		"forbidden_status": {
+			in: `tsid {
+				forbidden_status 404
+			}`,
+			want: &Middleware{ForbiddenStatus: 404},
+		},
+		"forbidden_status not a number": {
+			in: `tsid {
+				forbidden_status nope
+			}`,
+			wantErr: true,
+		},
+		"deny_message": {
+			in: `tsid {
+				deny_message "Connect to {http.request.host} with Tailscale."
+			}`,
+			want: &Middleware{DenyMessage: "Connect to {http.request.host} with Tailscale."},
+		},
+		"cache_ttl": {
+			in: `tsid {
+				cache_ttl 1m
+			}`,
+			want: &Middleware{CacheTTL: caddy.Duration(time.Minute)},
+		},
+		"negative_cache_ttl": {
+			in: `tsid {
+				negative_cache_ttl 1s
+			}`,
+			want: &Middleware{NegativeCacheTTL: caddy.Duration(time.Second)},
+		},
+		"headers_up": {
+			in: `tsid {
+				headers_up
+				user_header X-User
+				name_header X-Name
+			}`,
+			want: &Middleware{HeadersUp: true, UserHeader: "X-User", NameHeader: "X-Name"},
+		},
+		"headers_up with argument": {
+			in: `tsid {
+				headers_up yes
+			}`,
+			wantErr: true,
+		},
+		"remote_user_header": {
+			in: `tsid {
+				remote_user_header
+			}`,
+			want: &Middleware{RemoteUser: true},
+		},
+		"remote_user_header with_email": {
+			in: `tsid {
+				remote_user_header with_email
+			}`,
+			want: &Middleware{RemoteUser: true, RemoteEmail: true},
+		},
+		"remote_user_header unknown option": {
+			in: `tsid {
+				remote_user_header with_phone
+			}`,
+			wantErr: true,
+		},
+		"on_error": {
+			in: `tsid {
+				on_error allow
+			}`,
+			want: &Middleware{OnError: "allow"},
+		},
+		"whois_timeout": {
+			in: `tsid {
+				whois_timeout 2s
+			}`,
+			want: &Middleware{WhoIsTimeout: caddy.Duration(2 * time.Second)},
+		},
+		"trusted_proxies": {
+			in: `tsid {
+				trusted_proxies 127.0.0.1 10.0.0.0/8
+				trusted_proxies ::1
+			}`,
+			want: &Middleware{TrustedProxies: []string{"127.0.0.1", "10.0.0.0/8", "::1"}},
+		},
+		"client_ip_header_proxies": {
+			in: `tsid {
+				client_ip_header_proxies 10.0.0.1
+				client_ip_header_proxies 10.0.0.2/31
+			}`,
+			want: &Middleware{ClientIPHeaderProxies: []string{"10.0.0.1", "10.0.0.2/31"}},
+		},
+		"client_ip_header_proxies without ranges": {
+			in: `tsid {
+				client_ip_header_proxies
+			}`,
+			wantErr: true,
+		},
+		"trusted_proxies without ranges": {
+			in: `tsid {
+				trusted_proxies
+			}`,
+			wantErr: true,
+		},
+		"require_cap": {
+			in: `tsid {
+				require_cap example.com/cap/admin
+				require_cap example.com/cap/user
+			}`,
+			want: &Middleware{RequireCaps: []string{"example.com/cap/admin", "example.com/cap/user"}},
+		},
+		"cap_placeholder": {
+			in: `tsid {
+				cap_placeholder example.com/cap/app role
+			}`,
+			want: &Middleware{CapPlaceholders: []CapPlaceholder{{Capability: "example.com/cap/app", Field: "role"}}},
+		},
+		"cap_placeholder without field": {
+			in: `tsid {
+				cap_placeholder example.com/cap/app
+			}`,
+			wantErr: true,
+		},
+		"allow_funnel": {
+			in: `tsid {
+				allow_funnel
+			}`,
+			want: &Middleware{AllowFunnel: true},
+		},
+		"max_key_expiry": {
+			in: `tsid {
+				max_key_expiry 7d
+			}`,
+			want: &Middleware{MaxKeyExpiry: caddy.Duration(7 * 24 * time.Hour)},
+		},
+		"require_tagged": {
+			in: `tsid {
+				require_tagged
+			}`,
+			want: &Middleware{RequireTagged: true},
+		},
+		"require_user": {
+			in: `tsid {
+				require_user
+			}`,
+			want: &Middleware{RequireUser: true},
+		},
+		"exclude_shared": {
+			in: `tsid {
+				exclude_shared
+			}`,
+			want: &Middleware{ExcludeShared: true},
+		},
+		"allow_ips": {
+			in: `tsid {
+				allow_ips 192.0.2.0/24 198.51.100.7
+			}`,
+			want: &Middleware{AllowIPs: []string{"192.0.2.0/24", "198.51.100.7"}},
+		},
+		"allow_domains": {
+			in: `tsid {
+				allow_domains example.com example.org
+			}`,
+			want: &Middleware{AllowDomains: []string{"example.com", "example.org"}},
+		},
+		"email_lowercase": {
+			in: `tsid {
+				email_lowercase
+			}`,
+			want: &Middleware{EmailLowercase: true},
+		},
+		"trust_loopback": {
+			in: `tsid {
+				trust_loopback
+			}`,
+			want: &Middleware{TrustLoopback: true},
+		},
+		"strip_headers": {
+			in: `tsid {
+				strip_headers X-Tailscale-User X-Tailscale-Email
+			}`,
+			want: &Middleware{StripHeaders: []string{"X-Tailscale-User", "X-Tailscale-Email"}},
+		},
+		"placeholder_prefix": {
+			in: `tsid {
+				placeholder_prefix ts
+			}`,
+			want: &Middleware{PlaceholderPrefix: "ts"},
+		},
+		"exempt_paths": {
+			in: `tsid {
+				exempt_paths /hooks/* /health
+			}`,
+			want: &Middleware{ExemptPaths: []string{"/hooks/*", "/health"}},
+		},
+		"watch_netmap": {
+			in: `tsid {
+				watch_netmap
+			}`,
+			want: &Middleware{WatchNetmap: true},
+		},
+		"unauthenticated_redirect": {
+			in: `tsid {
+				unauthenticated_redirect https://example.com/join
+			}`,
+			want: &Middleware{UnauthenticatedRedirect: "https://example.com/join"},
+		},
+		"accept_tailnets": {
+			in: `tsid {
+				accept_tailnets example.ts.net partner.ts.net
+			}`,
+			want: &Middleware{AcceptTailnets: []string{"example.ts.net", "partner.ts.net"}},
+		},
+		"require_cap min_version": {
+			in: `tsid {
+				require_cap example.com/cap/admin min_version 2
+			}`,
+			want: &Middleware{
+				RequireCaps:    []string{"example.com/cap/admin"},
+				CapMinVersions: map[string]int{"example.com/cap/admin": 2},
+			},
+		},
+		"require_cap min_version invalid": {
+			in: `tsid {
+				require_cap example.com/cap/admin min_version two
+			}`,
+			wantErr: true,
+		},
+		"require_cap unknown option": {
+			in: `tsid {
+				require_cap example.com/cap/admin max_version 2
+			}`,
+			wantErr: true,
+		},
+		"allow_users_file": {
+			in: `tsid {
+				allow_users_file /etc/caddy/users
+			}`,
+			want: &Middleware{AllowUsersFile: "/etc/caddy/users"},
+		},
+		"json_errors": {
+			in: `tsid {
+				json_errors
+			}`,
+			want: &Middleware{JSONErrors: true},
+		},
+		"require_authorized": {
+			in: `tsid {
+				require_authorized
+			}`,
+			want: &Middleware{RequireAuthorized: true},
+		},
+		"enforce": {
+			in: `tsid {
+				enforce off
+			}`,
+			want: &Middleware{Enforce: "off"},
+		},
+		"set_header": {
+			in: `tsid {
+				set_header X-Forwarded-User {http.vars.tailscale.email}
+				set_header X-Forwarded-Name {http.vars.tailscale.name}
+			}`,
+			want: &Middleware{SetHeaders: map[string]string{
+				"X-Forwarded-User": "{http.vars.tailscale.email}",
+				"X-Forwarded-Name": "{http.vars.tailscale.name}",
+			}},
+		},
+		"status_cache_ttl": {
+			in: `tsid {
+				status_cache_ttl 5m
+			}`,
+			want: &Middleware{StatusCacheTTL: caddy.Duration(5 * time.Minute)},
+		},
+		"deny_action": {
+			in: `tsid {
+				deny_action abort
+			}`,
+			want: &Middleware{DenyAction: "abort"},
+		},
+		"health_path": {
+			in: `tsid {
+				health_path /healthz
+			}`,
+			want: &Middleware{HealthPath: "/healthz"},
+		},
+		"require_self_host": {
+			in: `tsid {
+				require_self_host
+			}`,
+			want: &Middleware{RequireSelfHost: true},
+		},
+		"min_node_age": {
+			in: `tsid {
+				min_node_age 1h
+			}`,
+			want: &Middleware{MinNodeAge: caddy.Duration(time.Hour)},
+		},
+		"min_node_age deny_unknown": {
+			in: `tsid {
+				min_node_age 24h deny_unknown
+			}`,
+			want: &Middleware{MinNodeAge: caddy.Duration(24 * time.Hour), DenyUnknownNodeAge: true},
+		},
+		"min_node_age unknown option": {
+			in: `tsid {
+				min_node_age 1h allow_unknown
+			}`,
+			wantErr: true,
+		},
+		"whois_attempts and whois_backoff": {
+			in: `tsid {
+				whois_attempts 5
+				whois_backoff 250ms
+			}`,
+			want: &Middleware{WhoIsAttempts: 5, WhoIsBackoff: caddy.Duration(250 * time.Millisecond)},
+		},
+		"whois_attempts invalid": {
+			in: `tsid {
+				whois_attempts many
+			}`,
+			wantErr: true,
+		},
+		"allow_os": {
+			in: `tsid {
+				allow_os linux
+				allow_os macOS windows
+			}`,
+			want: &Middleware{AllowOS: []string{"linux", "macOS", "windows"}},
+		},
+		"placeholders": {
+			in: `tsid {
+				placeholders email tailnet
+			}`,
+			want: &Middleware{Placeholders: []string{"email", "tailnet"}},
+		},
+		"allow_login_regex": {
+			in: `tsid {
+				allow_login_regex ^svc-[a-z]+@corp$
+			}`,
+			want: &Middleware{AllowLoginRegex: "^svc-[a-z]+@corp$"},
+		},
+		"header_hmac_secret": {
+			in: `tsid {
+				headers_up
+				header_hmac_secret s3cr3t
+			}`,
+			want: &Middleware{HeadersUp: true, HeaderHMACSecret: "s3cr3t"},
+		},
+		"require_identity": {
+			in: `tsid {
+				require_identity
+			}`,
+			want: &Middleware{RequireIdentity: true},
+		},
+		"control_server": {
+			in: `tsid {
+				control_server headscale
+			}`,
+			want: &Middleware{ControlServer: "headscale"},
+		},
+		"rate_limit": {
+			in: `tsid {
+				rate_limit 100
+			}`,
+			want: &Middleware{RateLimit: 100},
+		},
+		"rate_limit with window": {
+			in: `tsid {
+				rate_limit 10 1s
+			}`,
+			want: &Middleware{RateLimit: 10, RateLimitWindow: caddy.Duration(time.Second)},
+		},
+		"rate_limit invalid": {
+			in: `tsid {
+				rate_limit lots
+			}`,
+			wantErr: true,
+		},
+		"startup_grace": {
+			in: `tsid {
+				startup_grace 2m
+			}`,
+			want: &Middleware{StartupGrace: caddy.Duration(2 * time.Minute)},
+		},
+		"audit": {
+			in: `tsid {
+				audit
+			}`,
+			want: &Middleware{Audit: true},
+		},
+		"cache_max_entries": {
+			in: `tsid {
+				cache_max_entries 1000
+			}`,
+			want: &Middleware{CacheMaxEntries: 1000},
+		},
+		"cache_max_entries invalid": {
+			in: `tsid {
+				cache_max_entries many
+			}`,
+			wantErr: true,
+		},
+		"ip_families": {
+			in: `tsid {
+				ip_families ipv4
+			}`,
+			want: &Middleware{IPFamilies: "ipv4"},
+		},
+		"require_magicdns_host": {
+			in: `tsid {
+				require_magicdns_host
+			}`,
+			want: &Middleware{RequireMagicDNSHost: true},
+		},
+		"cache_revalidate": {
+			in: `tsid {
+				cache_revalidate
+			}`,
+			want: &Middleware{CacheRevalidate: true},
+		},
+		"cache_ttl invalid": {
+			in: `tsid {
+				cache_ttl forever
+			}`,
+			wantErr: true,
+		},
+		"allow_users without logins": {
+			in: `tsid {
+				allow_users
+			}`,
+			wantErr: true,
+		},
+		"unknown subdirective": {
+			in: `tsid {
+				sockett /var/run/tailscale/tailscaled.sock
+			}`,
+			wantErr: true,
+		},
+		"arguments on directive line": {
+			in:      `tsid /var/run/tailscale/tailscaled.sock`,
+			wantErr: true,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			var m Middleware
+			err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tc.in))
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("got %+v, want error", &m)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(&m, tc.want) {
+				t.Errorf("got %+v, want %+v", &m, tc.want)
+			}
+		})
+	}
+}
+
+func TestUnmarshalCaddyfileErrors(t *testing.T) {
+	cases := map[string]struct {
+		in   string
+		want string
+	}{
+		"unknown subdirective": {
+			in: `tsid {
+				alow_users alice@example.com
+			}`,
+			want: `unrecognized subdirective "alow_users"`,
+		},
+		"arguments on directive line": {
+			in:   `tsid allow_users alice@example.com`,
+			want: "wrong argument count",
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			var m Middleware
+			err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tc.in))
+			if err == nil {
+				t.Fatalf("got %+v, want error", &m)
+			}
+			if !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("error = %q, want it to contain %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	in := `tsid {
+		placeholder_prefix ts
+		placeholders email tailnet
+		socket /var/run/tailscale/tailscaled.sock
+		allow_users alice@example.com bob@example.org
+		allow_users_file /etc/caddy/users
+		allow_domains example.com
+		allow_login_regex ^svc-[a-z]+@corp$
+		deny_users carol@example.net
+		allow_tags tag:ci tag:deploy
+		require_tagged
+		require_user
+		require_cap example.com/cap/admin min_version 2
+		cap_placeholder example.com/cap/app role
+		exclude_shared
+		allow_os linux
+		require_identity
+		require_authorized
+		require_self_host
+		require_magicdns_host
+		accept_tailnets example.ts.net
+		max_key_expiry 7d
+		min_node_age 24h deny_unknown
+		forbidden_status 404
+		deny_message "Connect to {http.request.host} with Tailscale."
+		deny_action abort
+		json_errors
+		email_lowercase
+		headers_up
+		header_hmac_secret s3cr3t
+		user_header X-User
+		name_header X-Name
+		set_header X-Forwarded-User {http.vars.tailscale.email}
+		strip_headers X-Tailscale-User X-Tailscale-Email
+		remote_user_header with_email
+		on_error allow
+		control_server headscale
+		ip_families ipv4
+		enforce off
+		audit
+		unauthenticated_redirect https://example.com/join
+		cache_max_entries 1000
+		cache_revalidate
+		rate_limit 10 1s
+		cache_ttl 1m
+		status_cache_ttl 5m
+		watch_netmap
+		negative_cache_ttl 1s
+		allow_funnel
+		allow_ips 192.0.2.0/24
+		health_path /healthz
+		exempt_paths /hooks/*
+		trust_loopback
+		trusted_proxies 127.0.0.1 10.0.0.0/8
+		client_ip_header_proxies 10.0.0.1
+		startup_grace 2m
+		whois_attempts 5
+		whois_backoff 250ms
+		whois_timeout 2s
+	}`
+	// This only has to parse, so some of the options conflict.
+	var fromCaddyfile Middleware
+	if err := fromCaddyfile.UnmarshalCaddyfile(caddyfile.NewTestDispenser(in)); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := json.Marshal(&fromCaddyfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fromJSON Middleware
+	if err := json.Unmarshal(b, &fromJSON); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&fromJSON, &fromCaddyfile) {
+		t.Errorf("loaded from JSON:\n%+v\nwant:\n%+v\nJSON:\n%s", &fromJSON, &fromCaddyfile, b)
+	}
+
+	// Every option must survive the round trip, so every exported field
+	// needs a JSON name.
+	typ := reflect.TypeFor[Middleware]()
+	for i := range typ.NumField() {
+		f := typ.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue // such as Client
+		}
+		if name == "" {
+			t.Errorf("field %s has no JSON name", f.Name)
+		}
+		if reflect.ValueOf(&fromCaddyfile).Elem().Field(i).IsZero() {
+			t.Errorf("field %s isn't set by the Caddyfile in this test", f.Name)
+		}
+	}
+}
+
+func TestProvisionSocket(t *testing.T) {
+	cases := map[string]struct {
+		socket string
+		env    map[string]string
+		want   string
+	}{
+		"default": {
+			want: "",
+		},
+		"TS_SOCKET": {
+			env:  map[string]string{"TS_SOCKET": "/run/lc.sock"},
+			want: "/run/lc.sock",
+		},
+		"TAILSCALE_SOCKET": {
+			env:  map[string]string{"TAILSCALE_SOCKET": "/run/tailscale.sock"},
+			want: "/run/tailscale.sock",
+		},
+		"TS_SOCKET wins": {
+			env:  map[string]string{"TS_SOCKET": "/run/lc.sock", "TAILSCALE_SOCKET": "/run/tailscale.sock"},
+			want: "/run/lc.sock",
+		},
+		"directive wins": {
+			socket: "/run/configured.sock",
+			env:    map[string]string{"TS_SOCKET": "/run/lc.sock"},
+			want:   "/run/configured.sock",
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			for _, env := range socketEnvVars {
+				t.Setenv(env, tc.env[env])
+			}
+			m := &Middleware{Socket: tc.socket}
+			if err := m.Provision(newContext(t)); err != nil {
+				t.Fatal(err)
+			}
+			if got := m.lc.(*local.Client).Socket; got != tc.want {
+				t.Errorf("socket = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestTailnetPlaceholder(t *testing.T) {
+	lc := newFakeClient()
+	lc.delay = 10 * time.Millisecond
+	m := &Middleware{Placeholders: []string{"tailnet"}}
+	lc.provision(t, m)
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := newRequest(aliceAddr)
+			if _, _, err := serve(t, m, r); err != nil {
+				t.Error(err)
+				return
+			}
+			if got, want := getVar(r, "tailscale.tailnet"), "example.ts.net"; got != want {
+				t.Errorf("tailnet = %v, want %q", got, want)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := lc.statusCalls.Load(); got != 1 {
+		t.Errorf("Status called %d times, want 1", got)
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	lc := newFakeClient()
+	m := &Middleware{}
+	lc.provision(t, m)
+
+	cases := map[string]struct {
+		remoteAddr string
+		wantStatus int
+		wantVars   map[string]string
+	}{
+		"not a Tailscale IP": {
+			remoteAddr: "192.0.2.1:1234",
+			wantStatus: http.StatusForbidden,
+		},
+		"unknown peer": {
+			remoteAddr: "100.64.0.2:1234",
+			wantStatus: http.StatusForbidden,
+		},
+		"peer": {
+			remoteAddr: aliceAddr,
+			wantVars: map[string]string{
+				"tailscale.name":          "Alice",
+				"tailscale.email":         "alice@example.com",
+				"tailscale.profile_pic":   "https://example.com/alice.png",
+				"tailscale.user_id":       "12345",
+				"tailscale.node.hostname": "laptop",
+			},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			r := newRequest(tc.remoteAddr)
+			_, called, err := serve(t, m, r)
+			if got := statusCode(err); got != tc.wantStatus {
+				t.Fatalf("status = %d, want %d (err: %v)", got, tc.wantStatus, err)
+			}
+			if called != (tc.wantStatus == 0) {
+				t.Errorf("next called = %v, want %v", called, tc.wantStatus == 0)
+			}
+			if tc.wantStatus != 0 {
+				if got := getVar(r, "tailscale.user_id"); got != nil {
+					t.Errorf("user_id = %v for a denied request", got)
+				}
+			}
+			for name, want := range tc.wantVars {
+				if got := getVar(r, name); got != want {
+					t.Errorf("%s = %v, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestStatusCacheTTL(t *testing.T) {
+	lc := newFakeClient()
+	m := &Middleware{StatusCacheTTL: caddy.Duration(time.Minute), Placeholders: []string{"tailnet"}}
+	lc.provision(t, m)
+
+	for range 3 {
+		if _, _, err := serve(t, m, newRequest(aliceAddr)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := lc.statusCalls.Load(); got != 1 {
+		t.Errorf("Status called %d times within TTL, want 1", got)
+	}
+
+	// Expire the cached status.
+	m.mu.Lock()
+	m.statusExpires = time.Now().Add(-time.Second)
+	m.mu.Unlock()
+	if _, _, err := serve(t, m, newRequest(aliceAddr)); err != nil {
+		t.Fatal(err)
+	}
+	if got := lc.statusCalls.Load(); got != 2 {
+		t.Errorf("Status called %d times after expiry, want 2", got)
+	}
+}
+
+func TestConcurrentStatus(t *testing.T) {
+	lc := newFakeClient()
+	lc.delay = 10 * time.Millisecond
+	m := &Middleware{RequireSelfHost: true}
+	lc.provision(t, m)
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := newRequest(aliceAddr)
+			r.Host = "server.example.ts.net"
+			if _, called, err := serve(t, m, r); err != nil || !called {
+				t.Errorf("denied (err: %v), want allowed", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := lc.statusCalls.Load(); got != 1 {
+		t.Errorf("Status called %d times, want 1", got)
+	}
+}
+
+func TestStatusTimeout(t *testing.T) {
+	lc := newFakeClient()
+	lc.delay = time.Minute
+	m := &Middleware{RequireSelfHost: true, WhoIsTimeout: caddy.Duration(10 * time.Millisecond)}
+	lc.provision(t, m)
+
+	r := newRequest(aliceAddr)
+	r.Host = "server.example.ts.net"
+	start := time.Now()
+	_, called, err := serve(t, m, r)
+	if called || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("request took %v, want it to time out after whois_timeout", elapsed)
+	}
+}
+
+func BenchmarkServeHTTP(b *testing.B) {
+	lc := newFakeClient()
+	m := &Middleware{}
+	lc.provision(b, m)
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		return nil
+	})
+
+	for b.Loop() {
+		if err := m.ServeHTTP(httptest.NewRecorder(), newRequest(aliceAddr), next); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if got := lc.statusCalls.Load(); got != 1 {
+		b.Errorf("Status called %d times, want 1", got)
+	}
+}
+
+func TestNodeHostname(t *testing.T) {
+	cases := map[string]struct {
+		node *tailcfg.Node
+		want string
+	}{
+		"nil":           {node: nil, want: ""},
+		"computed name": {node: &tailcfg.Node{Name: "laptop.example.ts.net.", ComputedName: "laptop"}, want: "laptop"},
+		"name":          {node: &tailcfg.Node{Name: "laptop.example.ts.net."}, want: "laptop.example.ts.net."},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			if got := nodeHostname(tc.node); got != tc.want {
+				t.Errorf("nodeHostname() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestNodeIDPlaceholder(t *testing.T) {
+	lc := newFakeClient()
+	lc.peers[netip.MustParseAddr("100.64.0.6")] = &apitype.WhoIsResponse{
+		Node:        &tailcfg.Node{Name: "laptop.example.ts.net.", StableID: "nABC123CNTRL"},
+		UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"},
+	}
+	lc.peers[netip.MustParseAddr("100.64.0.7")] = &apitype.WhoIsResponse{
+		UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"},
+	}
+	m := &Middleware{}
+	lc.provision(t, m)
+
+	for addr, want := range map[string]string{
+		"100.64.0.6:1234": "nABC123CNTRL",
+		"100.64.0.7:1234": "",
+	} {
+		r := newRequest(addr)
+		if _, _, err := serve(t, m, r); err != nil {
+			t.Fatal(err)
+		}
+		if got := getVar(r, "tailscale.node.id"); got != want {
+			t.Errorf("%s: tailscale.node.id = %v, want %q", addr, got, want)
+		}
+	}
+}
+
+func TestNodeRoutes(t *testing.T) {
+	cases := map[string]struct {
+		node *tailcfg.Node
+		want string
+	}{
+		"nil":       {node: nil, want: ""},
+		"no routes": {node: &tailcfg.Node{}, want: ""},
+		"routes": {
+			node: &tailcfg.Node{PrimaryRoutes: []netip.Prefix{
+				netip.MustParsePrefix("192.168.1.0/24"),
+				netip.MustParsePrefix("fd7a:115c:a1e0:b1a::/64"),
+			}},
+			want: "192.168.1.0/24,fd7a:115c:a1e0:b1a::/64",
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			if got := nodeRoutes(tc.node); got != tc.want {
+				t.Errorf("nodeRoutes() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestNodeRoutesPlaceholder(t *testing.T) {
+	lc := newFakeClient()
+	lc.peers[netip.MustParseAddr("100.64.0.6")] = &apitype.WhoIsResponse{
+		Node: &tailcfg.Node{Name: "router.example.ts.net.", PrimaryRoutes: []netip.Prefix{
+			netip.MustParsePrefix("10.0.0.0/8"),
+			netip.MustParsePrefix("192.168.1.0/24"),
+		}},
+		UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"},
+	}
+	m := &Middleware{}
+	lc.provision(t, m)
+
+	for addr, want := range map[string]string{
+		"100.64.0.6:1234": "10.0.0.0/8,192.168.1.0/24",
+		aliceAddr:         "",
+	} {
+		r := newRequest(addr)
+		if _, _, err := serve(t, m, r); err != nil {
+			t.Fatal(err)
+		}
+		if got := getVar(r, "tailscale.node.routes"); got != want {
+			t.Errorf("%s: tailscale.node.routes = %v, want %q", addr, got, want)
+		}
+	}
+}
+
+func TestIsExitNode(t *testing.T) {
+	cases := map[string]struct {
+		node *tailcfg.Node
+		want bool
+	}{
+		"nil":       {node: nil, want: false},
+		"no routes": {node: &tailcfg.Node{}, want: false},
+		"subnet router": {
+			node: &tailcfg.Node{PrimaryRoutes: []netip.Prefix{netip.MustParsePrefix("192.168.1.0/24")}},
+			want: false,
+		},
+		"ipv4 default route": {
+			node: &tailcfg.Node{AllowedIPs: []netip.Prefix{
+				netip.MustParsePrefix("100.64.0.6/32"),
+				netip.MustParsePrefix("0.0.0.0/0"),
+			}},
+			want: true,
+		},
+		"ipv6 default route": {
+			node: &tailcfg.Node{PrimaryRoutes: []netip.Prefix{netip.MustParsePrefix("::/0")}},
+			want: true,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			if got := isExitNode(tc.node); got != tc.want {
+				t.Errorf("isExitNode() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestIsExitNodePlaceholder(t *testing.T) {
+	lc := newFakeClient()
+	lc.peers[netip.MustParseAddr("100.64.0.6")] = &apitype.WhoIsResponse{
+		Node: &tailcfg.Node{Name: "exit.example.ts.net.", AllowedIPs: []netip.Prefix{
+			netip.MustParsePrefix("100.64.0.6/32"),
+			netip.MustParsePrefix("0.0.0.0/0"),
+			netip.MustParsePrefix("::/0"),
+		}},
+		UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"},
+	}
+	m := &Middleware{}
+	lc.provision(t, m)
+
+	for addr, want := range map[string]string{
+		"100.64.0.6:1234": "true",
+		aliceAddr:         "false",
+	} {
+		r := newRequest(addr)
+		if _, called, err := serve(t, m, r); err != nil || !called {
+			t.Fatalf("%s: denied (err: %v), want allowed", addr, err)
+		}
+		if got := getVar(r, "tailscale.node.is_exit_node"); got != want {
+			t.Errorf("%s: tailscale.node.is_exit_node = %v, want %q", addr, got, want)
+		}
+	}
+}
+
+func TestNodeTagsPlaceholder(t *testing.T) {
+	lc := newFakeClient()
+	lc.peers[netip.MustParseAddr("100.64.0.3")] = &apitype.WhoIsResponse{
+		Node:        &tailcfg.Node{Name: "server.example.ts.net.", Tags: []string{"tag:server", "tag:ci"}},
+		UserProfile: &tailcfg.UserProfile{LoginName: "tagged-devices"},
+	}
+	m := &Middleware{}
+	lc.provision(t, m)
+
+	for addr, want := range map[string]string{
+		"100.64.0.3:1234": "tag:server,tag:ci",
+		aliceAddr:         "",
+	} {
+		r := newRequest(addr)
+		if _, _, err := serve(t, m, r); err != nil {
+			t.Fatal(err)
+		}
+		if got := getVar(r, "tailscale.node.tags"); got != want {
+			t.Errorf("%s: tags = %v, want %q", addr, got, want)
+		}
+	}
+}
+
+func TestUserID(t *testing.T) {
+	cases := map[string]struct {
+		profile *tailcfg.UserProfile
+		want    string
+	}{
+		"nil":     {profile: nil, want: ""},
+		"no ID":   {profile: &tailcfg.UserProfile{LoginName: "alice@example.com"}, want: ""},
+		"user ID": {profile: &tailcfg.UserProfile{ID: 12345}, want: "12345"},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			if got := userID(tc.profile); got != tc.want {
+				t.Errorf("userID() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+// testAccess checks that m, provisioned with a fakeTailscaled, passes on
+// requests from the addresses in allowed and denies those in denied with
+// m.ForbiddenStatus.
+func testAccess(t *testing.T, m *Middleware, allowed, denied []string) {
+	t.Helper()
+	for _, addr := range allowed {
+		if _, called, err := serve(t, m, newRequest(addr)); err != nil || !called {
+			t.Errorf("%s: denied (err: %v), want allowed", addr, err)
+		}
+	}
+	for _, addr := range denied {
+		if _, called, err := serve(t, m, newRequest(addr)); called || statusCode(err) != m.ForbiddenStatus {
+			t.Errorf("%s: got status %d, want %d", addr, statusCode(err), m.ForbiddenStatus)
+		}
+	}
+}
+
+func TestAccessRules(t *testing.T) {
+	cases := map[string]struct {
+		m       *Middleware
+		allowed []string
+		denied  []string
+	}{
+		"no rules": {
+			m:       &Middleware{},
+			allowed: []string{aliceAddr, bobAddr, ciAddr},
+		},
+		"allow_users": {
+			m:       &Middleware{AllowUsers: []string{"alice@example.com"}},
+			allowed: []string{aliceAddr},
+			denied:  []string{bobAddr, ciAddr},
+		},
+		"allow_users is case-insensitive": {
+			m:       &Middleware{AllowUsers: []string{"Alice@Example.com"}},
+			allowed: []string{aliceAddr},
+			denied:  []string{bobAddr},
+		},
+		"deny_users": {
+			m:       &Middleware{DenyUsers: []string{"BOB@example.org"}},
+			allowed: []string{aliceAddr},
+			denied:  []string{bobAddr},
+		},
+		"deny_users wins over allow_users": {
+			m: &Middleware{
+				AllowUsers: []string{"alice@example.com", "bob@example.org"},
+				DenyUsers:  []string{"bob@example.org"},
+			},
+			allowed: []string{aliceAddr},
+			denied:  []string{bobAddr},
+		},
+		"allow_tags": {
+			m:       &Middleware{AllowTags: []string{"tag:deploy", "tag:ci"}},
+			allowed: []string{ciAddr},
+			denied:  []string{aliceAddr, bobAddr},
+		},
+		"allow_domains": {
+			m:       &Middleware{AllowDomains: []string{"Example.org"}},
+			allowed: []string{bobAddr},
+			denied:  []string{aliceAddr, ciAddr},
+		},
+		"allow_domains or allow_users": {
+			m:       &Middleware{AllowUsers: []string{"alice@example.com"}, AllowDomains: []string{"example.org"}},
+			allowed: []string{aliceAddr, bobAddr},
+			denied:  []string{ciAddr},
+		},
+		"allow_tags or allow_users": {
+			m:       &Middleware{AllowUsers: []string{"alice@example.com"}, AllowTags: []string{"tag:ci"}},
+			allowed: []string{aliceAddr, ciAddr},
+			denied:  []string{bobAddr},
+		},
+		"allow_tags or allow_domains": {
+			m:       &Middleware{AllowDomains: []string{"example.org"}, AllowTags: []string{"tag:ci"}},
+			allowed: []string{bobAddr, ciAddr},
+			denied:  []string{aliceAddr},
+		},
+		"deny_users wins over allow_domains": {
+			m: &Middleware{
+				AllowDomains: []string{"example.com", "example.org"},
+				DenyUsers:    []string{"bob@example.org"},
+			},
+			allowed: []string{aliceAddr},
+			denied:  []string{bobAddr, ciAddr},
+		},
+		"deny_users wins over allow_tags": {
+			m: &Middleware{
+				AllowUsers: []string{"alice@example.com"},
+				AllowTags:  []string{"tag:ci"},
+				DenyUsers:  []string{"tagged-devices"},
+			},
+			allowed: []string{aliceAddr},
+			denied:  []string{bobAddr, ciAddr},
+		},
+		"allow_login_regex": {
+			m:       &Middleware{AllowLoginRegex: `^[a-z]+@example\.org$`},
+			allowed: []string{bobAddr},
+			denied:  []string{aliceAddr, ciAddr},
+		},
+		"allow_login_regex isn't anchored": {
+			m:       &Middleware{AllowLoginRegex: `example`},
+			allowed: []string{aliceAddr, bobAddr},
+			denied:  []string{ciAddr},
+		},
+		"allow_login_regex or allow_tags": {
+			m:       &Middleware{AllowLoginRegex: `^alice@`, AllowTags: []string{"tag:ci"}},
+			allowed: []string{aliceAddr, ciAddr},
+			denied:  []string{bobAddr},
+		},
+		"require_tagged": {
+			m:       &Middleware{RequireTagged: true},
+			allowed: []string{ciAddr},
+			denied:  []string{aliceAddr, bobAddr},
+		},
+		"require_user": {
+			m:       &Middleware{RequireUser: true},
+			allowed: []string{aliceAddr, bobAddr},
+			denied:  []string{ciAddr},
+		},
+		"require_cap": {
+			m:       &Middleware{RequireCaps: []string{"example.com/cap/admin"}},
+			allowed: []string{aliceAddr},
+			denied:  []string{bobAddr, ciAddr},
+		},
+		"require_cap without values": {
+			m:       &Middleware{RequireCaps: []string{"example.com/cap/user"}},
+			allowed: []string{aliceAddr, bobAddr},
+			denied:  []string{ciAddr},
+		},
+		"require_cap repeated": {
+			m:       &Middleware{RequireCaps: []string{"example.com/cap/admin", "example.com/cap/user"}},
+			allowed: []string{aliceAddr, bobAddr},
+			denied:  []string{ciAddr},
+		},
+		"allow_users or require_cap": {
+			m: &Middleware{
+				AllowUsers:  []string{"bob@example.org"},
+				RequireCaps: []string{"example.com/cap/admin"},
+			},
+			allowed: []string{aliceAddr, bobAddr},
+			denied:  []string{ciAddr},
+		},
+		"allow_tags or require_cap": {
+			m: &Middleware{
+				AllowTags:   []string{"tag:ci"},
+				RequireCaps: []string{"example.com/cap/admin"},
+			},
+			allowed: []string{aliceAddr, ciAddr},
+			denied:  []string{bobAddr},
+		},
+		"forbidden_status": {
+			m:       &Middleware{AllowUsers: []string{"alice@example.com"}, ForbiddenStatus: http.StatusNotFound},
+			allowed: []string{aliceAddr},
+			denied:  []string{bobAddr, "100.64.0.2:1234", "192.0.2.1:1234"},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			lc := newFakeClient()
+			lc.provision(t, tc.m)
+			testAccess(t, tc.m, tc.allowed, tc.denied)
+		})
+	}
+}
+
+func TestAllowTagsNilNode(t *testing.T) {
+	lc := newFakeClient()
+	lc.peers[netip.MustParseAddr("100.64.0.6")] = &apitype.WhoIsResponse{
+		UserProfile: &tailcfg.UserProfile{LoginName: "tagged-devices"},
+	}
+	for _, m := range []*Middleware{
+		{AllowTags: []string{"tag:ci"}},
+		{RequireTagged: true},
+	} {
+		lc.provision(t, m)
+		testAccess(t, m, nil, []string{"100.64.0.6:1234"})
+	}
+}
+
+func TestNilUserProfile(t *testing.T) {
+	lc := newFakeClient()
+	lc.peers[netip.MustParseAddr("100.64.0.6")] = &apitype.WhoIsResponse{
+		Node: &tailcfg.Node{Name: "node.example.ts.net.", Tags: []string{"tag:ci"}},
+	}
+	const addr = "100.64.0.6:1234"
+
+	cases := map[string]struct {
+		m       *Middleware
+		allowed bool
+	}{
+		"no rules":          {m: &Middleware{}, allowed: true},
+		"allow_tags":        {m: &Middleware{AllowTags: []string{"tag:ci"}}, allowed: true},
+		"allow_users":       {m: &Middleware{AllowUsers: []string{"alice@example.com"}}},
+		"allow_login_regex": {m: &Middleware{AllowLoginRegex: ".+"}},
+		"deny_users":        {m: &Middleware{DenyUsers: []string{"alice@example.com"}}, allowed: true},
+		"require_identity":  {m: &Middleware{RequireIdentity: true}},
+		"require_user":      {m: &Middleware{RequireUser: true}},
+		"headers_up":        {m: &Middleware{HeadersUp: true}, allowed: true},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			lc.provision(t, tc.m)
+			r := newRequest(addr)
+			_, called, err := serve(t, tc.m, r)
+			if called != tc.allowed {
+				t.Fatalf("called = %v, want %v (err: %v)", called, tc.allowed, err)
+			}
+			if tc.allowed {
+				if got := getVar(r, "tailscale.email"); got != nil && got != "" {
+					t.Errorf("tailscale.email = %q, want empty", got)
+				}
+			}
+		})
+	}
+}
+
+func TestAllowTagsGlob(t *testing.T) {
+	lc := newFakeClient()
+	for addr, tag := range map[string]string{
+		"100.64.0.6": "tag:svc-api",
+		"100.64.0.7": "tag:svc-web",
+		"100.64.0.8": "tag:db",
+	} {
+		lc.peers[netip.MustParseAddr(addr)] = &apitype.WhoIsResponse{
+			Node:        &tailcfg.Node{Name: "svc.example.ts.net.", Tags: []string{tag}},
+			UserProfile: &tailcfg.UserProfile{LoginName: "tagged-devices"},
+		}
+	}
+	m := &Middleware{AllowTags: []string{"tag:svc-*", "tag:ci"}}
+	lc.provision(t, m)
+	testAccess(t, m,
+		[]string{"100.64.0.6:1234", "100.64.0.7:1234", ciAddr},
+		[]string{"100.64.0.8:1234", aliceAddr},
+	)
+}
+
+func TestIPFamilies(t *testing.T) {
+	const alice6Addr = "[fd7a:115c:a1e0::1]:1234"
+	lc := newFakeClient()
+	lc.peers[netip.MustParseAddrPort(alice6Addr).Addr()] = alice
+
+	cases := map[string]struct {
+		families string
+		allowed  []string
+		denied   []string
+	}{
+		"default": {allowed: []string{aliceAddr, alice6Addr}},
+		"both":    {families: "both", allowed: []string{aliceAddr, alice6Addr}},
+		"ipv4":    {families: "ipv4", allowed: []string{aliceAddr}, denied: []string{alice6Addr}},
+		"ipv6":    {families: "ipv6", allowed: []string{alice6Addr}, denied: []string{aliceAddr}},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			m := &Middleware{IPFamilies: tc.families}
+			lc.provision(t, m)
+			testAccess(t, m, tc.allowed, tc.denied)
+		})
+	}
+}
+
+func TestValidateForbiddenStatus(t *testing.T) {
+	for _, code := range []int{200, 302, 600} {
+		m := &Middleware{ForbiddenStatus: code}
+		if err := m.Provision(newContext(t)); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Validate(); err == nil {
+			t.Errorf("forbidden_status %d: got no error", code)
+		}
+	}
+}
+
+func TestDenyMessage(t *testing.T) {
+	lc := newFakeClient()
+	m := &Middleware{
+		ForbiddenStatus: http.StatusNotFound,
+		DenyMessage:     "Connect to {http.request.host} with Tailscale.",
+	}
+	lc.provision(t, m)
+
+	w, called, err := serve(t, m, newRequest("192.0.2.1:1234"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if called {
+		t.Error("next handler called for a denied request")
+	}
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if got, want := w.Body.String(), "Connect to example.com with Tailscale."; got != want {
+		t.Errorf("body = %q, want %q", got, want)
+	}
+}
+
+func TestJSONErrors(t *testing.T) {
+	lc := newFakeClient()
+	m := &Middleware{
+		ForbiddenStatus: http.StatusNotFound,
+		AllowUsers:      []string{"alice@example.com"},
+		JSONErrors:      true,
+	}
+	lc.provision(t, m)
+
+	cases := map[string]struct {
+		remoteAddr string
+		want       map[string]string
+	}{
+		"not a Tailscale IP": {
+			remoteAddr: "192.0.2.1:1234",
+			want:       map[string]string{"error": "not_tailscale_ip", "reason": "not a Tailscale IP"},
+		},
+		"not authorized": {
+			remoteAddr: bobAddr,
+			want:       map[string]string{"error": "not_authorized", "reason": "not authorized"},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			w, called, err := serve(t, m, newRequest(tc.remoteAddr))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if called {
+				t.Error("next handler called for a denied request")
+			}
+			if w.Code != http.StatusNotFound {
+				t.Errorf("status = %d, want %d", w.Code, http.StatusNotFound)
+			}
+			if got, want := w.Header().Get("Content-Type"), "application/json"; got != want {
+				t.Errorf("Content-Type = %q, want %q", got, want)
+			}
+			var got map[string]string
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("body = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestValidateJSONErrors(t *testing.T) {
+	m := &Middleware{JSONErrors: true, DenyMessage: "Go away."}
+	if err := m.Provision(newContext(t)); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Validate(); err == nil {
+		t.Error("got no error")
+	}
+}
+
+func TestDenyActionAbort(t *testing.T) {
+	lc := newFakeClient()
+	m := &Middleware{DenyAction: "abort", AllowUsers: []string{"alice@example.com"}}
+	lc.provision(t, m)
+
+	if _, called, err := serve(t, m, newRequest(aliceAddr)); err != nil || !called {
+		t.Fatalf("allowed request: denied (err: %v)", err)
+	}
+
+	for _, addr := range []string{bobAddr, "192.0.2.1:1234"} {
+		w := httptest.NewRecorder()
+		func() {
+			defer func() {
+				if rec := recover(); rec != http.ErrAbortHandler {
+					t.Errorf("%s: recovered %v, want http.ErrAbortHandler", addr, rec)
+				}
+			}()
+			m.ServeHTTP(w, newRequest(addr), caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				t.Errorf("%s: next handler called for a denied request", addr)
+				return nil
+			}))
+		}()
+		if len(w.Header()) > 0 || w.Body.Len() > 0 || w.Flushed {
+			t.Errorf("%s: response written", addr)
+		}
+	}
+}
+
+func TestDenyActionAbortConnection(t *testing.T) {
+	lc := newFakeClient()
+	m := &Middleware{DenyAction: "abort"}
+	lc.provision(t, m)
+
+	// Requests from the test server come from 127.0.0.1, which is not a
+	// Tailscale IP.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(context.WithValue(r.Context(), caddyhttp.VarsCtxKey, map[string]any{}))
+		caddyhttp.NewTestReplacer(r)
+		m.ServeHTTP(w, r, caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			t.Error("next handler called for a denied request")
+			return nil
+		}))
+	}))
+	t.Cleanup(srv.Close)
+
+	resp, err := srv.Client().Get(srv.URL)
+	if err == nil {
+		resp.Body.Close()
+		t.Fatalf("got response with status %d, want a closed connection", resp.StatusCode)
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	lc := newFakeClient()
+	m := &Middleware{}
+	lc.provision(t, m)
+
+	for range 3 {
+		if _, _, err := serve(t, m, newRequest(aliceAddr)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := lc.whoisCalls.Load(); got != 1 {
+		t.Errorf("WhoIs called %d times, want 1", got)
+	}
+}
+
+func TestConcurrentWhoIs(t *testing.T) {
+	lc := newFakeClient()
+	lc.delay = 10 * time.Millisecond
+	m := &Middleware{}
+	lc.provision(t, m)
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, called, err := serve(t, m, newRequest(aliceAddr)); err != nil || !called {
+				t.Errorf("denied (err: %v), want allowed", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := lc.whoisCalls.Load(); got != 1 {
+		t.Errorf("WhoIs called %d times, want 1", got)
+	}
+}
+
+func TestNegativeCache(t *testing.T) {
+	lc := newFakeClient()
+	m := &Middleware{}
+	lc.provision(t, m)
+
+	for range 3 {
+		_, called, err := serve(t, m, newRequest("100.64.0.2:1234"))
+		if called {
+			t.Fatal("next handler called for unknown peer")
+		}
+		if got := statusCode(err); got != http.StatusForbidden {
+			t.Fatalf("got status %d, want %d", got, http.StatusForbidden)
+		}
+	}
+	if got := lc.whoisCalls.Load(); got != 1 {
+		t.Errorf("WhoIs called %d times, want 1", got)
+	}
+}
+
+func TestHeadersUp(t *testing.T) {
+	lc := newFakeClient()
+	spoofed := map[string]string{
+		"X-Tailscale-User": "mallory@example.com",
+		"X-Tailscale-Name": "Mallory",
+		"X-User":           "mallory@example.com",
+		"X-Name":           "Mallory",
+	}
+
+	cases := map[string]struct {
+		m          *Middleware
+		remoteAddr string
+		want       map[string]string // "" means the header is absent
+	}{
+		"disabled": {
+			m:          &Middleware{},
+			remoteAddr: aliceAddr,
+			want: map[string]string{
+				"X-Tailscale-User": "",
+				"X-Tailscale-Name": "",
+			},
+		},
+		"enabled": {
+			m:          &Middleware{HeadersUp: true},
+			remoteAddr: aliceAddr,
+			want: map[string]string{
+				"X-Tailscale-User": "alice@example.com",
+				"X-Tailscale-Name": "Alice",
+			},
+		},
+		"custom names": {
+			m:          &Middleware{HeadersUp: true, UserHeader: "X-User", NameHeader: "X-Name"},
+			remoteAddr: aliceAddr,
+			want: map[string]string{
+				"X-Tailscale-User": "mallory@example.com",
+				"X-User":           "alice@example.com",
+				"X-Name":           "Alice",
+			},
+		},
+		"denied": {
+			m:          &Middleware{HeadersUp: true},
+			remoteAddr: "100.64.0.2:1234",
+			want: map[string]string{
+				"X-Tailscale-User": "",
+				"X-Tailscale-Name": "",
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			lc.provision(t, tc.m)
+			r := newRequest(tc.remoteAddr)
+			for k, v := range spoofed {
+				r.Header.Set(k, v)
+			}
+			serve(t, tc.m, r)
+			for k, want := range tc.want {
+				if got := r.Header.Get(k); got != want {
+					t.Errorf("%s = %q, want %q", k, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSignHeaders(t *testing.T) {
+	sig := signHeaders("secret", "alice@example.com", "Alice")
+	if len(sig) != 64 {
+		t.Errorf("signature %q is not a hex-encoded SHA-256 HMAC", sig)
+	}
+	if again := signHeaders("secret", "alice@example.com", "Alice"); again != sig {
+		t.Errorf("signature changed from %q to %q", sig, again)
+	}
+	for name, other := range map[string]string{
+		"login":  signHeaders("secret", "bob@example.org", "Alice"),
+		"name":   signHeaders("secret", "alice@example.com", "Mallory"),
+		"secret": signHeaders("other", "alice@example.com", "Alice"),
+	} {
+		if other == sig {
+			t.Errorf("changing the %s doesn't change the signature", name)
+		}
+	}
+}
+
+func TestHeaderHMACSecret(t *testing.T) {
+	lc := newFakeClient()
+	m := &Middleware{HeadersUp: true, HeaderHMACSecret: "secret"}
+	lc.provision(t, m)
+
+	r := newRequest(aliceAddr)
+	r.Header.Set("X-Tailscale-Signature", "forged")
+	serve(t, m, r)
+
+	// Verify it the way an upstream would.
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(r.Header.Get("X-Tailscale-User") + "\n" + r.Header.Get("X-Tailscale-Name")))
+	want := hex.EncodeToString(mac.Sum(nil))
+	if got := r.Header.Get("X-Tailscale-Signature"); got != want {
+		t.Errorf("X-Tailscale-Signature = %q, want %q", got, want)
+	}
+
+	// Denied requests don't get a signature.
+	r = newRequest("100.64.0.2:1234")
+	r.Header.Set("X-Tailscale-Signature", "forged")
+	serve(t, m, r)
+	if got := r.Header.Get("X-Tailscale-Signature"); got != "" {
+		t.Errorf("X-Tailscale-Signature = %q for a denied request, want none", got)
+	}
+}
+
+func TestSetHeaders(t *testing.T) {
+	lc := newFakeClient()
+	m := &Middleware{SetHeaders: map[string]string{
+		"X-Forwarded-User": "{http.vars.tailscale.email}",
+		"X-Device":         "{http.vars.tailscale.node.hostname} ({http.vars.tailscale.name})",
+		"X-Tags":           "{http.vars.tailscale.node.tags}",
+	}}
+	lc.provision(t, m)
+
+	cases := map[string]struct {
+		remoteAddr string
+		want       map[string]string // "" means the header is absent
+	}{
+		"user": {
+			remoteAddr: aliceAddr,
+			want: map[string]string{
+				"X-Forwarded-User": "alice@example.com",
+				"X-Device":         "laptop (Alice)",
+				"X-Tags":           "",
+			},
+		},
+		"tagged": {
+			remoteAddr: ciAddr,
+			want: map[string]string{
+				"X-Tags": "tag:ci",
+			},
+		},
+		"unknown peer": {
+			remoteAddr: "100.64.0.2:1234",
+			want: map[string]string{
+				"X-Forwarded-User": "",
+				"X-Tags":           "",
+			},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			r := newRequest(tc.remoteAddr)
+			r.Header.Set("X-Forwarded-User", "mallory@example.com")
+			r.Header.Set("X-Tags", "tag:admin")
+			serve(t, m, r)
+			for k, want := range tc.want {
+				if got := r.Header.Get(k); got != want {
+					t.Errorf("%s = %q, want %q", k, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRemoteUser(t *testing.T) {
+	lc := newFakeClient()
+
+	cases := map[string]struct {
+		m          *Middleware
+		remoteAddr string
+		wantStatus int
+		wantUser   string
+		wantEmail  string
+	}{
+		"disabled": {
+			m:          &Middleware{},
+			remoteAddr: aliceAddr,
+		},
+		"remote user": {
+			m:          &Middleware{RemoteUser: true},
+			remoteAddr: aliceAddr,
+			wantUser:   "alice@example.com",
+		},
+		"with email": {
+			m:          &Middleware{RemoteUser: true, RemoteEmail: true},
+			remoteAddr: aliceAddr,
+			wantUser:   "alice@example.com",
+			wantEmail:  "alice@example.com",
+		},
+		"unknown peer": {
+			m:          &Middleware{RemoteUser: true, RemoteEmail: true},
+			remoteAddr: "100.64.0.2:1234",
+			wantStatus: http.StatusForbidden,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			lc.provision(t, tc.m)
+			w, _, err := serve(t, tc.m, newRequest(tc.remoteAddr))
+			if got := statusCode(err); got != tc.wantStatus {
+				t.Errorf("got status %d, want %d", got, tc.wantStatus)
+			}
+			if got := w.Header().Get("Remote-User"); got != tc.wantUser {
+				t.Errorf("Remote-User = %q, want %q", got, tc.wantUser)
+			}
+			if got := w.Header().Get("Remote-Email"); got != tc.wantEmail {
+				t.Errorf("Remote-Email = %q, want %q", got, tc.wantEmail)
+			}
+		})
+	}
+}
+
+func TestValidateOnError(t *testing.T) {
+	m := &Middleware{OnError: "ignore"}
+	if err := m.Provision(newContext(t)); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Validate(); err == nil {
+		t.Error("on_error ignore: got no error")
+	}
+}
+
+func TestOnError(t *testing.T) {
+	lc := newFakeClient()
+
+	cases := map[string]struct {
+		onError    string
+		down       bool
+		remoteAddr string
+		wantStatus int
+		wantCalled bool
+	}{
+		"deny, tailscaled down": {
+			onError:    "deny",
+			down:       true,
+			remoteAddr: aliceAddr,
+			wantStatus: http.StatusServiceUnavailable,
+		},
+		"default, tailscaled down": {
+			down:       true,
+			remoteAddr: aliceAddr,
+			wantStatus: http.StatusServiceUnavailable,
+		},
+		"allow, tailscaled down": {
+			onError:    "allow",
+			down:       true,
+			remoteAddr: aliceAddr,
+			wantCalled: true,
+		},
+		"allow, unknown peer": {
+			onError:    "allow",
+			remoteAddr: "100.64.0.2:1234",
+			wantStatus: http.StatusForbidden,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			m := &Middleware{OnError: tc.onError}
+			lc := lc
+			if tc.down {
+				lc = newFakeClient()
+				lc.err = errTailscaledDown
+			}
+			lc.provision(t, m)
+			r := newRequest(tc.remoteAddr)
+			_, called, err := serve(t, m, r)
+			if got := statusCode(err); got != tc.wantStatus {
+				t.Errorf("got status %d (%v), want %d", got, err, tc.wantStatus)
+			}
+			if called != tc.wantCalled {
+				t.Errorf("next handler called = %v, want %v", called, tc.wantCalled)
+			}
+			if got := getVar(r, "tailscale.email"); got != nil {
+				t.Errorf("tailscale.email = %v, want unset", got)
+			}
+		})
+	}
+}
+
+func TestStartupGrace(t *testing.T) {
+	cases := map[string]struct {
+		setup      func(lc *fakeClient, m *Middleware)
+		path       string
+		wantStatus int
+		wantRetry  bool
+	}{
+		"starting": {
+			wantStatus: http.StatusServiceUnavailable,
+			wantRetry:  true,
+		},
+		"grace elapsed": {
+			setup: func(lc *fakeClient, m *Middleware) {
+				m.started = time.Now().Add(-time.Minute)
+			},
+			wantStatus: http.StatusInternalServerError,
+		},
+		"answered before": {
+			setup: func(lc *fakeClient, m *Middleware) {
+				lc.err = nil
+				serve(t, m, newRequest(bobAddr))
+				lc.err = errTailscaledDown
+			},
+			wantStatus: http.StatusInternalServerError,
+		},
+		"health path": {
+			path: "/healthz",
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			lc := newFakeClient()
+			lc.err = errTailscaledDown
+			m := &Middleware{HealthPath: "/healthz", StartupGrace: caddy.Duration(30 * time.Second)}
+			lc.provision(t, m)
+			if tc.setup != nil {
+				tc.setup(lc, m)
+			}
+
+			r := newRequest(aliceAddr)
+			if tc.path != "" {
+				r.URL.Path = tc.path
+			}
+			w, _, err := serve(t, m, r)
+			if got := statusCode(err); got != tc.wantStatus {
+				t.Fatalf("got status %d (%v), want %d", got, err, tc.wantStatus)
+			}
+			if got := w.Header().Get("Retry-After") != ""; got != tc.wantRetry {
+				t.Errorf("Retry-After set = %v, want %v", got, tc.wantRetry)
+			}
+		})
+	}
+}
+
+func TestWhoIsTimeout(t *testing.T) {
+	lc := newFakeClient()
+	lc.delay = time.Second
+
+	cases := map[string]struct {
+		onError    string
+		wantStatus int
+		wantCalled bool
+	}{
+		"deny":  {onError: "deny", wantStatus: http.StatusServiceUnavailable},
+		"allow": {onError: "allow", wantCalled: true},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			m := &Middleware{
+				OnError:      tc.onError,
+				WhoIsTimeout: caddy.Duration(10 * time.Millisecond),
+			}
+			lc.provision(t, m)
+			start := time.Now()
+			_, called, err := serve(t, m, newRequest(aliceAddr))
+			if elapsed := time.Since(start); elapsed >= lc.delay {
+				t.Errorf("request took %v, want it to time out", elapsed)
+			}
+			if got := statusCode(err); got != tc.wantStatus {
+				t.Errorf("got status %d (%v), want %d", got, err, tc.wantStatus)
+			}
+			if called != tc.wantCalled {
+				t.Errorf("next handler called = %v, want %v", called, tc.wantCalled)
+			}
+		})
+	}
+}
+
+func TestWhoIsRetry(t *testing.T) {
+	cases := map[string]struct {
+		remoteAddr string
+		failures   int32
+		wantStatus int
+		wantCalls  int32
+	}{
+		"fails twice": {
+			remoteAddr: aliceAddr,
+			failures:   2,
+			wantCalls:  3,
+		},
+		"fails three times": {
+			remoteAddr: aliceAddr,
+			failures:   3,
+			wantStatus: http.StatusServiceUnavailable,
+			wantCalls:  3,
+		},
+		"unknown peer": {
+			remoteAddr: "100.64.0.2:1234",
+			wantStatus: http.StatusForbidden,
+			wantCalls:  1,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			lc := newFakeClient()
+			lc.whoisFailures.Store(tc.failures)
+			m := &Middleware{WhoIsBackoff: caddy.Duration(time.Millisecond)}
+			lc.provision(t, m)
+
+			_, _, err := serve(t, m, newRequest(tc.remoteAddr))
+			if got := statusCode(err); got != tc.wantStatus {
+				t.Errorf("got status %d (%v), want %d", got, err, tc.wantStatus)
+			}
+			if got := lc.whoisCalls.Load(); got != tc.wantCalls {
+				t.Errorf("WhoIs called %d times, want %d", got, tc.wantCalls)
+			}
+		})
+	}
+}
+
+func TestWhoIsRetryTimeout(t *testing.T) {
+	lc := newFakeClient()
+	lc.whoisFailures.Store(10)
+	m := &Middleware{
+		WhoIsAttempts: 10,
+		WhoIsBackoff:  caddy.Duration(time.Second),
+		WhoIsTimeout:  caddy.Duration(10 * time.Millisecond),
+	}
+	lc.provision(t, m)
+
+	start := time.Now()
+	_, _, err := serve(t, m, newRequest(aliceAddr))
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("request took %v, want it to stop at whois_timeout", elapsed)
+	}
+	if got := statusCode(err); got != http.StatusServiceUnavailable {
+		t.Errorf("got status %d (%v), want %d", got, err, http.StatusServiceUnavailable)
+	}
+	if got := lc.whoisCalls.Load(); got != 1 {
+		t.Errorf("WhoIs called %d times, want 1", got)
+	}
+}
+
+func TestValidateRequireUserAndTagged(t *testing.T) {
+	m := &Middleware{RequireUser: true, RequireTagged: true}
+	if err := m.Provision(newContext(t)); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Validate(); err == nil {
+		t.Error("got no error for require_user with require_tagged")
+	}
+}
+
+func TestValidateInvalid(t *testing.T) {
+	cases := map[string]*Middleware{
+		"require_user with allow_tags":  {RequireUser: true, AllowTags: []string{"tag:ci"}},
+		"empty allow_users entry":       {AllowUsers: []string{"alice@example.com", ""}},
+		"empty allow_domains entry":     {AllowDomains: []string{""}},
+		"empty deny_users entry":        {DenyUsers: []string{""}},
+		"empty allow_tags entry":        {AllowTags: []string{"tag:ci", ""}},
+		"empty allow_os entry":          {AllowOS: []string{""}},
+		"unknown placeholder":           {Placeholders: []string{"email", "node.owner"}},
+		"negative cache_ttl":            {CacheTTL: caddy.Duration(-time.Second)},
+		"negative negative_cache_ttl":   {NegativeCacheTTL: caddy.Duration(-time.Second)},
+		"negative whois_timeout":        {WhoIsTimeout: caddy.Duration(-time.Second)},
+		"negative max_key_expiry":       {MaxKeyExpiry: caddy.Duration(-time.Hour)},
+		"negative whois_backoff":        {WhoIsBackoff: caddy.Duration(-time.Second)},
+		"negative whois_attempts":       {WhoIsAttempts: -1},
+		"negative rate_limit":           {RateLimit: -1},
+		"negative startup_grace":        {StartupGrace: caddy.Duration(-time.Second)},
+		"negative rate_limit_window":    {RateLimit: 10, RateLimitWindow: caddy.Duration(-time.Second)},
+		"forbidden_status out of range": {ForbiddenStatus: 302},
+		"invalid allow_tags pattern":    {AllowTags: []string{"tag:svc-["}},
+		"negative cache_max_entries":    {CacheMaxEntries: -1},
+		"unknown ip_families":           {IPFamilies: "ipv5"},
+		"cap_min_versions without require_cap": {
+			RequireCaps:    []string{"example.com/cap/user"},
+			CapMinVersions: map[string]int{"example.com/cap/admin": 2},
+		},
+	}
+	for name, m := range cases {
+		t.Run(name, func(t *testing.T) {
+			if err := m.Provision(newContext(t)); err != nil {
+				t.Fatal(err)
+			}
+			if err := m.Validate(); err == nil {
+				t.Error("got no error")
+			}
+		})
+	}
+}
+
+func TestProvisionAllowLoginRegex(t *testing.T) {
+	m := &Middleware{AllowLoginRegex: `^svc-(.*@corp$`, Client: newFakeClient()}
+	if err := m.Provision(newContext(t)); err == nil {
+		t.Error("got no error for an invalid pattern")
+	}
+}
+
+func TestValidatePlaceholderPrefix(t *testing.T) {
+	for _, prefix := range []string{"tailscale.user", "{tailscale}", "tail scale"} {
+		m := &Middleware{PlaceholderPrefix: prefix}
+		if err := m.Provision(newContext(t)); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Validate(); err == nil {
+			t.Errorf("placeholder_prefix %q: got no error", prefix)
+		}
+	}
+}
+
+func TestValidateDefaults(t *testing.T) {
+	m := &Middleware{}
+	if err := m.Provision(newContext(t)); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Validate(); err != nil {
+		t.Errorf("default config: %v", err)
+	}
+}
+
+func TestCleanup(t *testing.T) {
+	lc := newFakeClient()
+	m := &Middleware{}
+	lc.provision(t, m)
+
+	if _, _, err := serve(t, m, newRequest(aliceAddr)); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	m.cache.mu.Lock()
+	defer m.cache.mu.Unlock()
+	if n := len(m.cache.entries); n != 0 {
+		t.Errorf("%d cache entries left after Cleanup", n)
+	}
+}
+
+func TestCleanupCancelsLookups(t *testing.T) {
+	cases := map[string]struct {
+		onError    string
+		wantStatus int
+		wantCalled bool
+	}{
+		"deny":  {onError: "deny", wantStatus: http.StatusServiceUnavailable},
+		"allow": {onError: "allow", wantCalled: true},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			lc := newFakeClient()
+			lc.delay = time.Minute
+			m := &Middleware{OnError: tc.onError}
+			lc.provision(t, m)
+
+			type result struct {
+				called bool
+				err    error
+			}
+			done := make(chan result)
+			go func() {
+				_, called, err := serve(t, m, newRequest(aliceAddr))
+				done <- result{called, err}
+			}()
+			waitFor(t, func() bool { return lc.whoisCalls.Load() > 0 })
+			m.Cleanup()
+
+			select {
+			case res := <-done:
+				if got := statusCode(res.err); got != tc.wantStatus {
+					t.Errorf("got status %d (%v), want %d", got, res.err, tc.wantStatus)
+				}
+				if res.called != tc.wantCalled {
+					t.Errorf("next handler called = %v, want %v", res.called, tc.wantCalled)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("lookup not canceled by Cleanup")
+			}
+		})
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	lc := newFakeClient()
+
+	cases := map[string]struct {
+		proxies    []string
+		remoteAddr string
+		forwarded  string
+		wantStatus int
+		wantUser   any
+	}{
+		"no trusted proxies": {
+			remoteAddr: "127.0.0.1:1234",
+			forwarded:  "100.64.0.1",
+			wantStatus: http.StatusForbidden,
+		},
+		"trusted proxy": {
+			proxies:    []string{"127.0.0.1"},
+			remoteAddr: "127.0.0.1:1234",
+			forwarded:  "100.64.0.1",
+			wantUser:   "alice@example.com",
+		},
+		"untrusted proxy": {
+			proxies:    []string{"127.0.0.1"},
+			remoteAddr: "192.0.2.1:1234",
+			forwarded:  "100.64.0.1",
+			wantStatus: http.StatusForbidden,
+		},
+		"peer not behind a proxy": {
+			proxies:    []string{"127.0.0.1"},
+			remoteAddr: bobAddr,
+			forwarded:  "100.64.0.1",
+			wantUser:   "bob@example.org",
+		},
+		"chain of trusted proxies": {
+			proxies:    []string{"127.0.0.1", "10.0.0.0/8"},
+			remoteAddr: "127.0.0.1:1234",
+			forwarded:  "100.64.0.1, 10.0.0.2, 10.0.0.1",
+			wantUser:   "alice@example.com",
+		},
+		"spoofed left-most address": {
+			proxies:    []string{"127.0.0.1"},
+			remoteAddr: "127.0.0.1:1234",
+			forwarded:  "100.64.0.1, 192.0.2.1",
+			wantStatus: http.StatusForbidden,
+		},
+		"invalid address": {
+			proxies:    []string{"127.0.0.1"},
+			remoteAddr: "127.0.0.1:1234",
+			forwarded:  "alice",
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			m := &Middleware{TrustedProxies: tc.proxies}
+			lc.provision(t, m)
+			r := newRequest(tc.remoteAddr)
+			r.Header.Set("X-Forwarded-For", tc.forwarded)
+			_, _, err := serve(t, m, r)
+			if got := statusCode(err); got != tc.wantStatus {
+				t.Errorf("got status %d (%v), want %d", got, err, tc.wantStatus)
+			}
+			if got := getVar(r, "tailscale.email"); got != tc.wantUser {
+				t.Errorf("tailscale.email = %v, want %v", got, tc.wantUser)
+			}
+		})
+	}
+}
+
+func TestClientIPHeader(t *testing.T) {
+	lc := newFakeClient()
+	m := &Middleware{
+		ClientIPHeaderProxies: []string{"127.0.0.1"},
+		TrustedProxies:        []string{"127.0.0.1", "10.0.0.1"},
+	}
+	lc.provision(t, m)
+
+	cases := map[string]struct {
+		remoteAddr string
+		clientIP   string
+		forwarded  string
+		wantStatus int
+		wantUser   any
+	}{
+		"trusted proxy": {
+			remoteAddr: "127.0.0.1:1234",
+			clientIP:   "100.64.0.1",
+			wantUser:   "alice@example.com",
+		},
+		"preferred over X-Forwarded-For": {
+			remoteAddr: "127.0.0.1:1234",
+			clientIP:   "100.64.0.4",
+			forwarded:  "100.64.0.1",
+			wantUser:   "bob@example.org",
+		},
+		"invalid address": {
+			remoteAddr: "127.0.0.1:1234",
+			clientIP:   "alice",
+			wantStatus: http.StatusBadRequest,
+		},
+		"not a Tailscale IP": {
+			remoteAddr: "127.0.0.1:1234",
+			clientIP:   "192.0.2.1",
+			wantStatus: http.StatusBadRequest,
+		},
+		"untrusted proxy": {
+			remoteAddr: "192.0.2.1:1234",
+			clientIP:   "100.64.0.1",
+			wantStatus: http.StatusForbidden,
+		},
+		"only in trusted_proxies": {
+			remoteAddr: "10.0.0.1:1234",
+			clientIP:   "100.64.0.1",
+			forwarded:  "100.64.0.4",
+			wantUser:   "bob@example.org",
+		},
+		"without header": {
+			remoteAddr: "127.0.0.1:1234",
+			forwarded:  "100.64.0.4",
+			wantUser:   "bob@example.org",
+		},
+		"peer not behind a proxy": {
+			remoteAddr: bobAddr,
+			clientIP:   "100.64.0.1",
+			wantUser:   "bob@example.org",
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			r := newRequest(tc.remoteAddr)
+			if tc.clientIP != "" {
+				r.Header.Set("Tailscale-Client-IP", tc.clientIP)
+			}
+			if tc.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", tc.forwarded)
+			}
+			_, _, err := serve(t, m, r)
+			if got := statusCode(err); got != tc.wantStatus {
+				t.Fatalf("got status %d (%v), want %d", got, err, tc.wantStatus)
+			}
+			if got := getVar(r, "tailscale.email"); got != tc.wantUser {
+				t.Errorf("tailscale.email = %v, want %v", got, tc.wantUser)
+			}
+		})
+	}
+}
+
+// TestForwardAuthSpoofedClientIP checks that the forward_auth setup from
+// the README can't be fooled by a Tailscale-Client-IP header sent by the
+// client, which forward_auth passes through.
+func TestForwardAuthSpoofedClientIP(t *testing.T) {
+	lc := newFakeClient()
+	m := &Middleware{
+		TrustedProxies: []string{"127.0.0.1", "::1"},
+		RemoteUser:     true,
+		RemoteEmail:    true,
+	}
+	lc.provision(t, m)
+
+	r := newRequest("127.0.0.1:1234")
+	r.Header.Set("Tailscale-Client-IP", "100.64.0.1")
+	r.Header.Set("X-Forwarded-For", "203.0.113.7")
+	w, called, err := serve(t, m, r)
+	if called {
+		t.Error("request with a spoofed Tailscale-Client-IP passed on")
+	}
+	if got := statusCode(err); got != http.StatusForbidden {
+		t.Errorf("got status %d (%v), want %d", got, err, http.StatusForbidden)
+	}
+	if got := w.Header().Get("Remote-User"); got != "" {
+		t.Errorf("Remote-User = %q, want empty", got)
+	}
+}
+
+func TestIPv4MappedAddr(t *testing.T) {
+	lc := newFakeClient()
+	m := &Middleware{TrustedProxies: []string{"127.0.0.1"}}
+	lc.provision(t, m)
+
+	cases := map[string]struct {
+		remoteAddr string
+		forwarded  string
+		wantStatus int
+		wantUser   any
+	}{
+		"peer": {
+			remoteAddr: "[::ffff:100.64.0.1]:1234",
+			wantUser:   "alice@example.com",
+		},
+		"not a Tailscale IP": {
+			remoteAddr: "[::ffff:192.0.2.1]:1234",
+			wantStatus: http.StatusForbidden,
+		},
+		"trusted proxy": {
+			remoteAddr: "[::ffff:127.0.0.1]:1234",
+			forwarded:  "::ffff:100.64.0.4",
+			wantUser:   "bob@example.org",
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			r := newRequest(tc.remoteAddr)
+			if tc.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", tc.forwarded)
+			}
+			_, _, err := serve(t, m, r)
+			if got := statusCode(err); got != tc.wantStatus {
+				t.Fatalf("got status %d, want %d", got, tc.wantStatus)
+			}
+			if got := getVar(r, "tailscale.email"); got != tc.wantUser {
+				t.Errorf("tailscale.email = %v, want %v", got, tc.wantUser)
+			}
+		})
+	}
+}
+
+func TestProvisionPrefixes(t *testing.T) {
+	for _, m := range []*Middleware{
+		{TrustedProxies: []string{"localhost"}},
+		{ClientIPHeaderProxies: []string{"10.0.0.1/40"}},
+		{AllowIPs: []string{"192.0.2.0/33"}},
+	} {
+		if err := m.Provision(newContext(t)); err == nil {
+			t.Errorf("%+v: got no error for an invalid IP range", m)
+		}
+	}
+}
+
+func TestCapField(t *testing.T) {
+	cm := tailcfg.PeerCapMap{
+		"example.com/cap/app":   {`{"role":"editor","level":2}`},
+		"example.com/cap/multi": {`{"role":"editor"}`, `{"level":1}`, `{"role":"admin"}`},
+		"example.com/cap/bad":   {`"editor"`},
+	}
+
+	cases := map[string]struct {
+		capability, field string
+		want              string
+		wantErr           bool
+	}{
+		"string":          {capability: "example.com/cap/app", field: "role", want: "editor"},
+		"number":          {capability: "example.com/cap/app", field: "level", want: "2"},
+		"missing field":   {capability: "example.com/cap/app", field: "team", want: ""},
+		"missing cap":     {capability: "example.com/cap/none", field: "role", want: ""},
+		"multiple grants": {capability: "example.com/cap/multi", field: "role", want: "editor,admin"},
+		"malformed grant": {capability: "example.com/cap/bad", field: "role", wantErr: true},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got, err := capField(cm, tc.capability, tc.field)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("got error %v, want error: %v", err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCapPlaceholders(t *testing.T) {
+	lc := newFakeClient()
+	lc.peers[netip.MustParseAddr("100.64.0.6")] = &apitype.WhoIsResponse{
+		Node:        &tailcfg.Node{Name: "editor.example.ts.net.", ComputedName: "editor"},
+		UserProfile: &tailcfg.UserProfile{LoginName: "carol@example.com"},
+		CapMap: tailcfg.PeerCapMap{
+			"example.com/cap/app":  {`{"role":"editor"}`},
+			"example.com/cap/team": {`{"team":"docs"}`, `{"team":"web"}`},
+			"example.com/cap/bad":  {`["editor"]`},
+		},
+	}
+	m := &Middleware{CapPlaceholders: []CapPlaceholder{
+		{Capability: "example.com/cap/app", Field: "role"},
+		{Capability: "example.com/cap/team", Field: "team"},
+		{Capability: "example.com/cap/bad", Field: "bad"},
+	}}
+	lc.provision(t, m)
+
+	r := newRequest("100.64.0.6:1234")
+	if _, called, err := serve(t, m, r); err != nil || !called {
+		t.Fatalf("request denied: %v", err)
+	}
+	for name, want := range map[string]any{
+		"tailscale.role": "editor",
+		"tailscale.team": "docs,web",
+		"tailscale.bad":  nil,
+	} {
+		if got := getVar(r, name); got != want {
+			t.Errorf("%s = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestFunnel(t *testing.T) {
+	lc := newFakeClient()
+
+	cases := map[string]struct {
+		allowFunnel bool
+		remoteAddr  string
+		funnel      bool
+		wantStatus  int
+		wantFunnel  any
+	}{
+		"disabled": {
+			remoteAddr: "127.0.0.1:1234",
+			funnel:     true,
+			wantStatus: http.StatusForbidden,
+		},
+		"enabled": {
+			allowFunnel: true,
+			remoteAddr:  "127.0.0.1:1234",
+			funnel:      true,
+			wantFunnel:  "true",
+		},
+		"enabled, IPv6 loopback": {
+			allowFunnel: true,
+			remoteAddr:  "[::1]:1234",
+			funnel:      true,
+			wantFunnel:  "true",
+		},
+		"enabled, not a Funnel request": {
+			allowFunnel: true,
+			remoteAddr:  "127.0.0.1:1234",
+			wantStatus:  http.StatusForbidden,
+		},
+		"enabled, spoofed header": {
+			allowFunnel: true,
+			remoteAddr:  "192.0.2.1:1234",
+			funnel:      true,
+			wantStatus:  http.StatusForbidden,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			m := &Middleware{AllowFunnel: tc.allowFunnel}
+			lc.provision(t, m)
+			r := newRequest(tc.remoteAddr)
+			if tc.funnel {
+				r.Header.Set("Tailscale-Funnel-Request", "?1")
+			}
+			_, _, err := serve(t, m, r)
+			if got := statusCode(err); got != tc.wantStatus {
+				t.Errorf("got status %d (%v), want %d", got, err, tc.wantStatus)
+			}
+			if got := getVar(r, "tailscale.funnel"); got != tc.wantFunnel {
+				t.Errorf("tailscale.funnel = %v, want %v", got, tc.wantFunnel)
+			}
+			if got := getVar(r, "tailscale.email"); got != nil {
+				t.Errorf("tailscale.email = %v, want unset", got)
+			}
+		})
+	}
+}
+
+func TestNodeOSPlaceholders(t *testing.T) {
+	lc := newFakeClient()
+	lc.peers[netip.MustParseAddr("100.64.0.6")] = &apitype.WhoIsResponse{
+		Node: &tailcfg.Node{
+			Name:     "phone.example.ts.net.",
+			Hostinfo: (&tailcfg.Hostinfo{OS: "iOS", OSVersion: "17.4", DeviceModel: "iPhone15,2"}).View(),
+		},
+		UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"},
+	}
+	lc.peers[netip.MustParseAddr("100.64.0.7")] = &apitype.WhoIsResponse{
+		Node: &tailcfg.Node{
+			Name:     "server.example.ts.net.",
+			Hostinfo: (&tailcfg.Hostinfo{OS: "linux"}).View(),
+		},
+		UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"},
+	}
+	m := &Middleware{}
+	lc.provision(t, m)
+
+	cases := map[string]struct {
+		remoteAddr      string
+		wantOS          string
+		wantOSVersion   string
+		wantDeviceModel string
+	}{
+		"with hostinfo":        {remoteAddr: "100.64.0.6:1234", wantOS: "iOS", wantOSVersion: "17.4", wantDeviceModel: "iPhone15,2"},
+		"without device model": {remoteAddr: "100.64.0.7:1234", wantOS: "linux"},
+		"without hostinfo":     {remoteAddr: aliceAddr},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			r := newRequest(tc.remoteAddr)
+			if _, _, err := serve(t, m, r); err != nil {
+				t.Fatal(err)
+			}
+			if got := getVar(r, "tailscale.node.os"); got != tc.wantOS {
+				t.Errorf("tailscale.node.os = %v, want %q", got, tc.wantOS)
+			}
+			if got := getVar(r, "tailscale.node.os_version"); got != tc.wantOSVersion {
+				t.Errorf("tailscale.node.os_version = %v, want %q", got, tc.wantOSVersion)
+			}
+			if got := getVar(r, "tailscale.node.device_model"); got != tc.wantDeviceModel {
+				t.Errorf("tailscale.node.device_model = %v, want %q", got, tc.wantDeviceModel)
+			}
+		})
+	}
+}
+
+func TestMaxKeyExpiry(t *testing.T) {
+	lc := newFakeClient()
+	now := time.Now()
+	for addr, expiry := range map[string]time.Time{
+		"100.64.0.6": now.Add(time.Hour),
+		"100.64.0.7": now.Add(-time.Hour),
+		"100.64.0.8": now.Add(30 * 24 * time.Hour),
+	} {
+		lc.peers[netip.MustParseAddr(addr)] = &apitype.WhoIsResponse{
+			Node:        &tailcfg.Node{Name: "node.example.ts.net.", KeyExpiry: expiry},
+			UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"},
+		}
+	}
+	m := &Middleware{MaxKeyExpiry: caddy.Duration(24 * time.Hour)}
+	lc.provision(t, m)
+
+	testAccess(t, m,
+		// Key valid for a month, key expiry disabled.
+		[]string{"100.64.0.8:1234", aliceAddr},
+		// Key expires soon, key expired.
+		[]string{"100.64.0.6:1234", "100.64.0.7:1234"},
+	)
+}
+
+func TestMinNodeAge(t *testing.T) {
+	lc := newFakeClient()
+	now := time.Now()
+	for addr, created := range map[string]time.Time{
+		"100.64.0.6": now.Add(-10 * time.Minute),
+		"100.64.0.7": now.Add(-30 * 24 * time.Hour),
+		"100.64.0.8": {},
+	} {
+		lc.peers[netip.MustParseAddr(addr)] = &apitype.WhoIsResponse{
+			Node:        &tailcfg.Node{Name: "node.example.ts.net.", Created: created},
+			UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"},
+		}
+	}
+
+	for _, tc := range []struct {
+		denyUnknown bool
+		allowed     []string
+		denied      []string
+	}{
+		{denyUnknown: false, allowed: []string{"100.64.0.7:1234", "100.64.0.8:1234"}, denied: []string{"100.64.0.6:1234"}},
+		{denyUnknown: true, allowed: []string{"100.64.0.7:1234"}, denied: []string{"100.64.0.6:1234", "100.64.0.8:1234"}},
+	} {
+		m := &Middleware{MinNodeAge: caddy.Duration(time.Hour), DenyUnknownNodeAge: tc.denyUnknown}
+		lc.provision(t, m)
+		testAccess(t, m, tc.allowed, tc.denied)
+	}
+}
+
+func TestNodeCreated(t *testing.T) {
+	cases := map[string]struct {
+		node *tailcfg.Node
+		want string
+	}{
+		"nil":     {node: nil, want: ""},
+		"unknown": {node: &tailcfg.Node{}, want: ""},
+		"created": {node: &tailcfg.Node{Created: time.Date(2023, 11, 2, 8, 0, 0, 0, time.UTC)}, want: "2023-11-02T08:00:00Z"},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			if got := nodeCreated(tc.node); got != tc.want {
+				t.Errorf("nodeCreated() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestExcludeShared(t *testing.T) {
+	lc := newFakeClient()
+	lc.peers[netip.MustParseAddr("100.64.0.6")] = &apitype.WhoIsResponse{
+		Node:        &tailcfg.Node{Name: "shared.other.ts.net.", Sharer: 45678},
+		UserProfile: &tailcfg.UserProfile{LoginName: "dave@example.net"},
+	}
+
+	for _, tc := range []struct {
+		excludeShared bool
+		allowed       []string
+		denied        []string
+	}{
+		{excludeShared: false, allowed: []string{aliceAddr, "100.64.0.6:1234"}},
+		{excludeShared: true, allowed: []string{aliceAddr}, denied: []string{"100.64.0.6:1234"}},
+	} {
+		m := &Middleware{ExcludeShared: tc.excludeShared}
+		lc.provision(t, m)
+		testAccess(t, m, tc.allowed, tc.denied)
+	}
+}
+
+func TestAllowOS(t *testing.T) {
+	lc := newFakeClient()
+	for addr, goos := range map[string]string{
+		"100.64.0.6": "linux",
+		"100.64.0.7": "iOS",
+		"100.64.0.8": "windows",
+	} {
+		lc.peers[netip.MustParseAddr(addr)] = &apitype.WhoIsResponse{
+			Node:        &tailcfg.Node{Name: "node.example.ts.net.", Hostinfo: (&tailcfg.Hostinfo{OS: goos}).View()},
+			UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"},
+		}
+	}
+	m := &Middleware{AllowOS: []string{"Linux", "ios"}}
+	lc.provision(t, m)
+
+	testAccess(t, m,
+		[]string{"100.64.0.6:1234", "100.64.0.7:1234"},
+		// Another OS, unknown OS.
+		[]string{"100.64.0.8:1234", aliceAddr},
+	)
+}
+
+func TestRequireIdentity(t *testing.T) {
+	lc := newFakeClient()
+	lc.peers[netip.MustParseAddr("100.64.0.6")] = &apitype.WhoIsResponse{
+		Node:        &tailcfg.Node{Name: "node.headscale.example."},
+		UserProfile: &tailcfg.UserProfile{},
+	}
+
+	for _, tc := range []struct {
+		requireIdentity bool
+		allowed         []string
+		denied          []string
+	}{
+		{requireIdentity: false, allowed: []string{aliceAddr, "100.64.0.6:1234"}},
+		{requireIdentity: true, allowed: []string{aliceAddr, ciAddr}, denied: []string{"100.64.0.6:1234"}},
+	} {
+		m := &Middleware{RequireIdentity: tc.requireIdentity}
+		lc.provision(t, m)
+		testAccess(t, m, tc.allowed, tc.denied)
+	}
+}
+
+func TestRequireAuthorized(t *testing.T) {
+	lc := newFakeClient()
+	lc.peers[netip.MustParseAddr("100.64.0.6")] = &apitype.WhoIsResponse{
+		Node:        &tailcfg.Node{Name: "approved.example.ts.net.", MachineAuthorized: true},
+		UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"},
+	}
+	lc.peers[netip.MustParseAddr("100.64.0.7")] = &apitype.WhoIsResponse{
+		Node:        &tailcfg.Node{Name: "pending.example.ts.net."},
+		UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"},
+	}
+	lc.peers[netip.MustParseAddr("100.64.0.8")] = &apitype.WhoIsResponse{
+		UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"},
+	}
+
+	for _, tc := range []struct {
+		requireAuthorized bool
+		allowed           []string
+		denied            []string
+	}{
+		{requireAuthorized: false, allowed: []string{"100.64.0.6:1234", "100.64.0.7:1234", "100.64.0.8:1234"}},
+		{requireAuthorized: true, allowed: []string{"100.64.0.6:1234"}, denied: []string{"100.64.0.7:1234", "100.64.0.8:1234"}},
+	} {
+		m := &Middleware{RequireAuthorized: tc.requireAuthorized}
+		lc.provision(t, m)
+		testAccess(t, m, tc.allowed, tc.denied)
+	}
+}
+
+func TestRequireSelfHost(t *testing.T) {
+	lc := newFakeClient()
+	m := &Middleware{RequireSelfHost: true}
+	lc.provision(t, m)
+
+	cases := map[string]bool{
+		"server.example.ts.net":      true,
+		"Server.Example.ts.net.":     true,
+		"server.example.ts.net:8443": true,
+		"server":                     true,
+		"other.example.ts.net":       false,
+		"server.example.com":         false,
+		"example.com":                false,
+		"":                           false,
+	}
+	for host, want := range cases {
+		t.Run(host, func(t *testing.T) {
+			r := newRequest(aliceAddr)
+			r.Host = host
+			_, called, err := serve(t, m, r)
+			if called != want {
+				t.Errorf("allowed = %v (err: %v), want %v", called, err, want)
+			}
+			if !want && statusCode(err) != http.StatusForbidden {
+				t.Errorf("got status %d, want %d", statusCode(err), http.StatusForbidden)
+			}
+		})
+	}
+}
+
+func TestRequireMagicDNSHost(t *testing.T) {
+	lc := newFakeClient()
+	m := &Middleware{RequireMagicDNSHost: true}
+	lc.provision(t, m)
+
+	cases := map[string]bool{
+		"server.example.ts.net":      true,
+		"laptop.example.ts.net":      true,
+		"Laptop.Example.ts.net.":     true,
+		"laptop.example.ts.net:8443": true,
+		"laptop":                     false,
+		"a.b.example.ts.net":         false,
+		"example.ts.net":             false,
+		"laptop.other.ts.net":        false,
+		"laptop.example.ts.net.evil": false,
+		"laptopexample.ts.net":       false,
+		"example.com":                false,
+		"100.64.0.1":                 false,
+		"100.64.0.1:443":             false,
+		"[fd7a:115c:a1e0::1]:443":    false,
+		"":                           false,
+	}
+	for host, want := range cases {
+		t.Run(host, func(t *testing.T) {
+			r := newRequest(aliceAddr)
+			r.Host = host
+			_, called, err := serve(t, m, r)
+			if called != want {
+				t.Errorf("allowed = %v (err: %v), want %v", called, err, want)
+			}
+			if !want && statusCode(err) != http.StatusForbidden {
+				t.Errorf("got status %d, want %d", statusCode(err), http.StatusForbidden)
+			}
+		})
+	}
+}
+
+func TestAllowIPs(t *testing.T) {
+	lc := newFakeClient()
+	m := &Middleware{AllowIPs: []string{"192.0.2.0/24"}}
+	lc.provision(t, m)
+
+	cases := map[string]struct {
+		remoteAddr        string
+		wantStatus        int
+		wantAuthenticated any
+		wantEmail         any
+	}{
+		"allowed IP": {
+			remoteAddr:        "192.0.2.1:1234",
+			wantAuthenticated: "false",
+		},
+		"other IP": {
+			remoteAddr: "198.51.100.7:1234",
+			wantStatus: http.StatusForbidden,
+		},
+		"peer": {
+			remoteAddr:        aliceAddr,
+			wantAuthenticated: "true",
+			wantEmail:         "alice@example.com",
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			r := newRequest(tc.remoteAddr)
+			_, _, err := serve(t, m, r)
+			if got := statusCode(err); got != tc.wantStatus {
+				t.Errorf("got status %d (%v), want %d", got, err, tc.wantStatus)
+			}
+			if got := getVar(r, "tailscale.authenticated"); got != tc.wantAuthenticated {
+				t.Errorf("tailscale.authenticated = %v, want %v", got, tc.wantAuthenticated)
+			}
+			if got := getVar(r, "tailscale.email"); got != tc.wantEmail {
+				t.Errorf("tailscale.email = %v, want %v", got, tc.wantEmail)
+			}
+		})
+	}
+}
+
+func TestWhoIsFromContext(t *testing.T) {
+	lc := newFakeClient()
+	m := &Middleware{AllowUsers: []string{"alice@example.com"}}
+	lc.provision(t, m)
+
+	cases := map[string]struct {
+		remoteAddr string
+		wantLogin  string
+	}{
+		"identified": {remoteAddr: aliceAddr, wantLogin: "alice@example.com"},
+		"denied":     {remoteAddr: bobAddr},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			var (
+				whois *apitype.WhoIsResponse
+				ok    bool
+			)
+			next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				whois, ok = WhoIsFromContext(r.Context())
+				return nil
+			})
+			m.ServeHTTP(httptest.NewRecorder(), newRequest(tc.remoteAddr), next)
+			if want := tc.wantLogin != ""; ok != want {
+				t.Fatalf("WhoIsFromContext() reported %v, want %v", ok, want)
+			}
+			if ok && whois.UserProfile.LoginName != tc.wantLogin {
+				t.Errorf("got login %q, want %q", whois.UserProfile.LoginName, tc.wantLogin)
+			}
+		})
+	}
+
+	if _, ok := WhoIsFromContext(context.Background()); ok {
+		t.Error("WhoIsFromContext() reported true for an empty context")
+	}
+}
+
+func TestLoginDomain(t *testing.T) {
+	cases := map[string]string{
+		"alice@example.com": "example.com",
+		"a@b@example.com":   "example.com",
+		"alice@github":      "github",
+		"tagged-devices":    "",
+		"":                  "",
+	}
+	for login, want := range cases {
+		if got := loginDomain(login); got != want {
+			t.Errorf("loginDomain(%q) = %q, want %q", login, got, want)
+		}
+	}
+}
+
+func TestEmailDomainPlaceholder(t *testing.T) {
+	lc := newFakeClient()
+	m := &Middleware{}
+	lc.provision(t, m)
+
+	for addr, want := range map[string]string{
+		aliceAddr: "example.com",
+		ciAddr:    "",
+	} {
+		r := newRequest(addr)
+		if _, _, err := serve(t, m, r); err != nil {
+			t.Fatal(err)
+		}
+		if got := getVar(r, "tailscale.email_domain"); got != want {
+			t.Errorf("%s: tailscale.email_domain = %v, want %q", addr, got, want)
+		}
+	}
+}
+
+func TestPrincipalPlaceholder(t *testing.T) {
+	lc := newFakeClient()
+	lc.peers[netip.MustParseAddr("100.64.0.6")] = &apitype.WhoIsResponse{
+		Node:        &tailcfg.Node{Name: "runner.example.ts.net.", Tags: []string{"tag:deploy", "tag:ci"}},
+		UserProfile: &tailcfg.UserProfile{LoginName: "tagged-devices"},
+	}
+	m := &Middleware{}
+	lc.provision(t, m)
+
+	for addr, want := range map[string]string{
+		aliceAddr:         "alice@example.com",
+		ciAddr:            "tag:ci",
+		"100.64.0.6:1234": "tag:deploy",
+	} {
+		r := newRequest(addr)
+		if _, _, err := serve(t, m, r); err != nil {
+			t.Fatal(err)
+		}
+		if got := getVar(r, "tailscale.principal"); got != want {
+			t.Errorf("%s: tailscale.principal = %v, want %q", addr, got, want)
+		}
+	}
+}
+
+func TestAccessLogPlaceholders(t *testing.T) {
+	lc := newFakeClient()
+	m := &Middleware{}
+	lc.provision(t, m)
+
+	r := newRequest(aliceAddr)
+	r = r.WithContext(context.WithValue(r.Context(), caddyhttp.ExtraLogFieldsCtxKey, new(caddyhttp.ExtraLogFields)))
+	if _, _, err := serve(t, m, r); err != nil {
+		t.Fatal(err)
+	}
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	for in, want := range map[string]string{
+		"{http.vars.tailscale.email}":         "alice@example.com",
+		"{http.vars.tailscale.node.hostname}": "laptop",
+	} {
+		if got := repl.ReplaceAll(in, ""); got != want {
+			t.Errorf("%s = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestEmailLowercase(t *testing.T) {
+	lc := newFakeClient()
+	lc.peers[netip.MustParseAddr("100.64.0.6")] = &apitype.WhoIsResponse{
+		Node:        &tailcfg.Node{Name: "laptop.example.ts.net."},
+		UserProfile: &tailcfg.UserProfile{LoginName: "Carol@Example.COM", DisplayName: "Carol"},
+	}
+
+	cases := map[string]struct {
+		m         *Middleware
+		wantEmail string
+	}{
+		"disabled": {
+			m:         &Middleware{},
+			wantEmail: "Carol@Example.COM",
+		},
+		"enabled": {
+			m:         &Middleware{EmailLowercase: true},
+			wantEmail: "carol@example.com",
+		},
+		"enabled with allow_domains": {
+			m:         &Middleware{EmailLowercase: true, AllowDomains: []string{"example.com"}},
+			wantEmail: "carol@example.com",
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			lc.provision(t, tc.m)
+			r := newRequest("100.64.0.6:1234")
+			if _, called, err := serve(t, tc.m, r); err != nil || !called {
+				t.Fatalf("request denied: %v", err)
+			}
+			if got := getVar(r, "tailscale.email"); got != tc.wantEmail {
+				t.Errorf("tailscale.email = %v, want %q", got, tc.wantEmail)
+			}
+			if got := getVar(r, "tailscale.name"); got != "Carol" {
+				t.Errorf("tailscale.name = %v, want %q", got, "Carol")
+			}
+		})
+	}
+}
+
+func TestTrustLoopback(t *testing.T) {
+	lc := newFakeClient()
+
+	cases := map[string]struct {
+		trustLoopback     bool
+		allowFunnel       bool
+		funnel            bool
+		remoteAddr        string
+		wantStatus        int
+		wantAuthenticated any
+		wantEmail         any
+	}{
+		"disabled": {
+			remoteAddr: "127.0.0.1:1234",
+			wantStatus: http.StatusForbidden,
+		},
+		"enabled": {
+			trustLoopback:     true,
+			remoteAddr:        "127.0.0.1:1234",
+			wantAuthenticated: "false",
+		},
+		"enabled, IPv6": {
+			trustLoopback:     true,
+			remoteAddr:        "[::1]:1234",
+			wantAuthenticated: "false",
+		},
+		"enabled, other IP": {
+			trustLoopback: true,
+			remoteAddr:    "192.0.2.1:1234",
+			wantStatus:    http.StatusForbidden,
+		},
+		"enabled, peer": {
+			trustLoopback:     true,
+			remoteAddr:        aliceAddr,
+			wantAuthenticated: "true",
+			wantEmail:         "alice@example.com",
+		},
+		"enabled, funnel": {
+			trustLoopback: true,
+			funnel:        true,
+			remoteAddr:    "127.0.0.1:1234",
+			wantStatus:    http.StatusForbidden,
+		},
+		"enabled, funnel allowed": {
+			trustLoopback:     true,
+			allowFunnel:       true,
+			funnel:            true,
+			remoteAddr:        "127.0.0.1:1234",
+			wantAuthenticated: "false",
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			m := &Middleware{TrustLoopback: tc.trustLoopback, AllowFunnel: tc.allowFunnel}
+			lc.provision(t, m)
+			r := newRequest(tc.remoteAddr)
+			if tc.funnel {
+				r.Header.Set("Tailscale-Funnel-Request", "?1")
+			}
+			_, _, err := serve(t, m, r)
+			if got := statusCode(err); got != tc.wantStatus {
+				t.Errorf("got status %d (%v), want %d", got, err, tc.wantStatus)
+			}
+			if got := getVar(r, "tailscale.authenticated"); got != tc.wantAuthenticated {
+				t.Errorf("tailscale.authenticated = %v, want %v", got, tc.wantAuthenticated)
+			}
+			if got := getVar(r, "tailscale.email"); got != tc.wantEmail {
+				t.Errorf("tailscale.email = %v, want %v", got, tc.wantEmail)
+			}
+		})
+	}
+}
+
+func TestStripHeaders(t *testing.T) {
+	lc := newFakeClient()
+	spoofed := []string{"X-Tailscale-User", "X-Tailscale-Name", "X-Tailscale-Email", "X-Other"}
+
+	cases := map[string]struct {
+		m          *Middleware
+		remoteAddr string
+		wantKept   []string
+	}{
+		"default": {
+			m:          &Middleware{},
+			remoteAddr: aliceAddr,
+			wantKept:   []string{"X-Tailscale-Email", "X-Other"},
+		},
+		"custom": {
+			m:          &Middleware{StripHeaders: []string{"X-Tailscale-Email"}},
+			remoteAddr: aliceAddr,
+			wantKept:   []string{"X-Other"},
+		},
+		"custom header names": {
+			m: &Middleware{
+				UserHeader:   "X-Other",
+				SetHeaders:   map[string]string{"X-Tailscale-Email": "{http.vars.tailscale.email}"},
+				StripHeaders: []string{"X-Tailscale-Name"},
+			},
+			remoteAddr: aliceAddr,
+			wantKept:   []string{"X-Tailscale-User"},
+		},
+		"allowed IP": {
+			m:          &Middleware{AllowIPs: []string{"192.0.2.1"}},
+			remoteAddr: "192.0.2.1:1234",
+			wantKept:   []string{"X-Tailscale-Email", "X-Other"},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			lc.provision(t, tc.m)
+			r := newRequest(tc.remoteAddr)
+			for _, h := range spoofed {
+				r.Header.Set(h, "spoofed")
+			}
+			var seen http.Header
+			next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				seen = r.Header
+				return nil
+			})
+			if err := tc.m.ServeHTTP(httptest.NewRecorder(), r, next); err != nil {
+				t.Fatal(err)
+			}
+			kept := make(map[string]bool)
+			for _, h := range tc.wantKept {
+				kept[h] = true
+			}
+			for _, h := range spoofed {
+				if got := seen.Get(h) == "spoofed"; got != kept[h] {
+					t.Errorf("%s kept = %v, want %v", h, got, kept[h])
+				}
+			}
+		})
+	}
+}
+
+func TestControlServerHeadscale(t *testing.T) {
+	// Headscale leaves out the display name and the tailnet.
+	lc := newFakeClient()
+	lc.status = &ipnstate.Status{BackendState: "Running"}
+	lc.peers[netip.MustParseAddr("100.64.0.6")] = &apitype.WhoIsResponse{
+		Node:        &tailcfg.Node{Name: "laptop.alice.headscale.example."},
+		UserProfile: &tailcfg.UserProfile{LoginName: "alice"},
+	}
+
+	cases := map[string]struct {
+		controlServer string
+		remoteAddr    string
+		wantName      string
+		wantTailnet   string
+	}{
+		"tailscale": {
+			remoteAddr: "100.64.0.6:1234",
+		},
+		"headscale": {
+			controlServer: "headscale",
+			remoteAddr:    "100.64.0.6:1234",
+			wantName:      "alice",
+			wantTailnet:   "alice.headscale.example",
+		},
+		"headscale with a display name": {
+			controlServer: "headscale",
+			remoteAddr:    aliceAddr,
+			wantName:      "Alice",
+			wantTailnet:   "example.ts.net",
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			m := &Middleware{ControlServer: tc.controlServer, HeadersUp: true, Placeholders: []string{"name", "tailnet"}}
+			lc.provision(t, m)
+			r := newRequest(tc.remoteAddr)
+			if _, _, err := serve(t, m, r); err != nil {
+				t.Fatal(err)
+			}
+			if got := getVar(r, "tailscale.name"); got != tc.wantName {
+				t.Errorf("tailscale.name = %v, want %q", got, tc.wantName)
+			}
+			if got := r.Header.Get("X-Tailscale-Name"); got != tc.wantName {
+				t.Errorf("X-Tailscale-Name = %q, want %q", got, tc.wantName)
+			}
+			if got := getVar(r, "tailscale.tailnet"); got != tc.wantTailnet {
+				t.Errorf("tailscale.tailnet = %v, want %q", got, tc.wantTailnet)
+			}
+		})
+	}
+}
+
+func TestValidateControlServer(t *testing.T) {
+	m := &Middleware{ControlServer: "ionscale"}
+	if err := m.Provision(newContext(t)); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Validate(); err == nil {
+		t.Error("control_server ionscale: got no error")
+	}
+}
+
+func TestReplacerPlaceholders(t *testing.T) {
+	lc := newFakeClient()
+	respond := &caddyhttp.StaticResponse{Body: "hello, {tailscale.email} ({http.vars.tailscale.email})"}
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		return respond.ServeHTTP(w, r, nil)
+	})
+
+	cases := map[string]struct {
+		m    *Middleware
+		want string
+	}{
+		"identified": {
+			m:    &Middleware{},
+			want: "hello, alice@example.com (alice@example.com)",
+		},
+		// respond leaves unknown placeholders as they are.
+		"cleared": {
+			m:    &Middleware{Enforce: enforceOff},
+			want: "hello, {tailscale.email} ()",
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			lc.provision(t, tc.m)
+			r := newRequest(aliceAddr)
+			r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer).Set("tailscale.email", "mallory@example.net")
+			caddyhttp.SetVar(r.Context(), "tailscale.email", "mallory@example.net")
+			w := httptest.NewRecorder()
+			if err := tc.m.ServeHTTP(w, r, next); err != nil {
+				t.Fatal(err)
+			}
+			if got := w.Body.String(); got != tc.want {
+				t.Errorf("body = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestWithoutReplacer(t *testing.T) {
+	lc := newFakeClient()
+
+	cases := map[string]struct {
+		m            *Middleware
+		remoteAddr   string
+		accept       string
+		wantBody     string
+		wantLocation string
+		wantHeader   string
+	}{
+		"deny_message": {
+			m:          &Middleware{DenyMessage: "{http.request.host} is only available on Tailscale"},
+			remoteAddr: "192.0.2.1:1234",
+			wantBody:   "{http.request.host} is only available on Tailscale",
+		},
+		"unauthenticated_redirect": {
+			m:            &Middleware{UnauthenticatedRedirect: "https://login.example.com/{http.request.host}"},
+			remoteAddr:   "192.0.2.1:1234",
+			accept:       "text/html",
+			wantLocation: "https://login.example.com/{http.request.host}",
+		},
+		"set_header": {
+			m:          &Middleware{SetHeaders: map[string]string{"X-User": "{tailscale.email}"}},
+			remoteAddr: aliceAddr,
+			wantHeader: "{tailscale.email}",
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			lc.provision(t, tc.m)
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			r.RemoteAddr = tc.remoteAddr
+			if tc.accept != "" {
+				r.Header.Set("Accept", tc.accept)
+			}
+			w, _, err := serve(t, tc.m, r)
+			if statusCode(err) == -1 {
+				t.Fatal(err)
+			}
+			if tc.wantBody != "" {
+				if got := w.Body.String(); got != tc.wantBody {
+					t.Errorf("body = %q, want %q", got, tc.wantBody)
+				}
+			}
+			if tc.wantLocation != "" {
+				if got := w.Header().Get("Location"); got != tc.wantLocation {
+					t.Errorf("Location = %q, want %q", got, tc.wantLocation)
+				}
+			}
+			if tc.wantHeader != "" {
+				if got := r.Header.Get("X-User"); got != tc.wantHeader {
+					t.Errorf("X-User = %q, want %q", got, tc.wantHeader)
+				}
+			}
+		})
+	}
+}
+
+func TestPlaceholders(t *testing.T) {
+	cases := map[string]struct {
+		placeholders []string
+		want         map[string]any // nil means unset
+		wantStatus   bool           // whether Status is called
+	}{
+		"default": {
+			want: map[string]any{
+				"tailscale.authenticated": "true",
+				"tailscale.name":          "Alice",
+				"tailscale.email":         "alice@example.com",
+				"tailscale.node.hostname": "laptop",
+				"tailscale.tailnet":       nil,
+			},
+		},
+		"email only": {
+			placeholders: []string{"email"},
+			want: map[string]any{
+				"tailscale.authenticated": "true",
+				"tailscale.name":          nil,
+				"tailscale.email":         "alice@example.com",
+				"tailscale.node.hostname": nil,
+				"tailscale.tailnet":       nil,
+			},
+		},
+		"email and tailnet": {
+			placeholders: []string{"email", "tailnet"},
+			want: map[string]any{
+				"tailscale.name":    nil,
+				"tailscale.email":   "alice@example.com",
+				"tailscale.tailnet": "example.ts.net",
+			},
+			wantStatus: true,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			lc := newFakeClient()
+			m := &Middleware{Placeholders: tc.placeholders}
+			lc.provision(t, m)
+
+			r := newRequest(aliceAddr)
+			if _, _, err := serve(t, m, r); err != nil {
+				t.Fatal(err)
+			}
+			for k, want := range tc.want {
+				if got := getVar(r, k); got != want {
+					t.Errorf("%s = %v, want %v", k, got, want)
+				}
+			}
+			if got := lc.statusCalls.Load() > 0; got != tc.wantStatus {
+				t.Errorf("Status called = %v, want %v", got, tc.wantStatus)
+			}
+		})
+	}
+}
+
+func TestPlaceholderPrefix(t *testing.T) {
+	lc := newFakeClient()
+	m := &Middleware{PlaceholderPrefix: "ts"}
+	lc.provision(t, m)
+
+	r := newRequest(aliceAddr)
+	if _, _, err := serve(t, m, r); err != nil {
+		t.Fatal(err)
+	}
+	if got := getVar(r, "ts.email"); got != "alice@example.com" {
+		t.Errorf("ts.email = %v, want %q", got, "alice@example.com")
+	}
+	if got := getVar(r, "ts.node.hostname"); got != "laptop" {
+		t.Errorf("ts.node.hostname = %v, want %q", got, "laptop")
+	}
+	if got := getVar(r, "tailscale.email"); got != nil {
+		t.Errorf("tailscale.email = %v, want unset", got)
+	}
+}
+
+func TestAuthenticatedPlaceholder(t *testing.T) {
+	lc := newFakeClient()
+	down := newFakeClient()
+	down.err = errTailscaledDown
+
+	cases := map[string]struct {
+		lc         *fakeClient
+		m          *Middleware
+		remoteAddr string
+		funnel     bool
+		want       any
+	}{
+		"peer": {
+			lc:         lc,
+			m:          &Middleware{},
+			remoteAddr: aliceAddr,
+			want:       "true",
+		},
+		"denied": {
+			lc:         lc,
+			m:          &Middleware{},
+			remoteAddr: "192.0.2.1:1234",
+		},
+		"on_error allow": {
+			lc:         down,
+			m:          &Middleware{OnError: "allow"},
+			remoteAddr: aliceAddr,
+			want:       "false",
+		},
+		"allow_ips": {
+			lc:         lc,
+			m:          &Middleware{AllowIPs: []string{"192.0.2.1"}},
+			remoteAddr: "192.0.2.1:1234",
+			want:       "false",
+		},
+		"trust_loopback": {
+			lc:         lc,
+			m:          &Middleware{TrustLoopback: true},
+			remoteAddr: "127.0.0.1:1234",
+			want:       "false",
+		},
+		"allow_funnel": {
+			lc:         lc,
+			m:          &Middleware{AllowFunnel: true},
+			remoteAddr: "127.0.0.1:1234",
+			funnel:     true,
+			want:       "false",
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			tc.lc.provision(t, tc.m)
+			r := newRequest(tc.remoteAddr)
+			if tc.funnel {
+				r.Header.Set("Tailscale-Funnel-Request", "?1")
+			}
+			serve(t, tc.m, r)
+			if got := getVar(r, "tailscale.authenticated"); got != tc.want {
+				t.Errorf("tailscale.authenticated = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestIdentitySource(t *testing.T) {
+	lc := newFakeClient()
+	m := &Middleware{ExemptPaths: []string{"/health"}, TrustLoopback: true}
+	lc.provision(t, m)
+
+	// In order: the first request for alice misses the cache.
+	for _, tc := range []struct {
+		name       string
+		path       string
+		remoteAddr string
+		want       string
+	}{
+		{name: "cold miss", path: "/", remoteAddr: aliceAddr, want: "live"},
+		{name: "warm hit", path: "/", remoteAddr: aliceAddr, want: "cache"},
+		{name: "exempt path", path: "/health", remoteAddr: aliceAddr, want: "bypass"},
+		{name: "loopback", path: "/", remoteAddr: "127.0.0.1:1234", want: "bypass"},
+		{name: "other peer", path: "/", remoteAddr: bobAddr, want: "live"},
+	} {
+		r := newRequest(tc.remoteAddr)
+		r.URL.Path = tc.path
+		if _, called, err := serve(t, m, r); err != nil || !called {
+			t.Fatalf("%s: denied (err: %v), want allowed", tc.name, err)
+		}
+		if got := getVar(r, "tailscale.identity_source"); got != tc.want {
+			t.Errorf("%s: tailscale.identity_source = %v, want %q", tc.name, got, tc.want)
+		}
+	}
+
+	// With on_error allow, requests passed on after tailscaled failed
+	// have no identity.
+	down := newFakeClient()
+	down.err = errTailscaledDown
+	for name, m := range map[string]*Middleware{
+		"on_error allow, WhoIs failed":  {OnError: "allow"},
+		"on_error allow, Status failed": {OnError: "allow", RequireSelfHost: true},
+	} {
+		down.provision(t, m)
+		r := newRequest(aliceAddr)
+		if _, called, err := serve(t, m, r); err != nil || !called {
+			t.Fatalf("%s: denied (err: %v), want allowed", name, err)
+		}
+		if got := getVar(r, "tailscale.identity_source"); got != "bypass" {
+			t.Errorf("%s: tailscale.identity_source = %v, want %q", name, got, "bypass")
+		}
+	}
+}
+
+func TestCacheRevalidate(t *testing.T) {
+	reassigned := netip.MustParseAddr("100.64.0.6")
+	dave := &apitype.WhoIsResponse{
+		Node:        &tailcfg.Node{Name: "tablet.example.ts.net."},
+		UserProfile: &tailcfg.UserProfile{LoginName: "dave@example.com"},
+	}
+
+	cases := map[string]struct {
+		revalidate bool
+		want       string
+	}{
+		"off": {revalidate: false, want: "alice@example.com"},
+		"on":  {revalidate: true, want: "dave@example.com"},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			lc := newFakeClient()
+			lc.peers[reassigned] = alice
+			m := &Middleware{CacheRevalidate: tc.revalidate}
+			lc.provision(t, m)
+
+			r := newRequest("100.64.0.6:1234")
+			if _, _, err := serve(t, m, r); err != nil {
+				t.Fatal(err)
+			}
+			if got := getVar(r, "tailscale.email"); got != "alice@example.com" {
+				t.Fatalf("tailscale.email = %v, want alice@example.com", got)
+			}
+
+			// The IP is reassigned to another node, which connects
+			// while alice is still cached.
+			lc.peers[reassigned] = dave
+			r = newRequest("100.64.0.6:5678")
+			if _, _, err := serve(t, m, r); err != nil {
+				t.Fatal(err)
+			}
+			if got := getVar(r, "tailscale.email"); got != tc.want {
+				t.Errorf("tailscale.email = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestExemptPaths(t *testing.T) {
+	lc := newFakeClient()
+	m := &Middleware{ExemptPaths: []string{"/hooks/*", "/health"}}
+	lc.provision(t, m)
+
+	cases := map[string]struct {
+		path       string
+		remoteAddr string
+		wantStatus int
+		wantEmail  any
+	}{
+		"exempt, outsider": {
+			path:       "/hooks/github",
+			remoteAddr: "192.0.2.1:1234",
+		},
+		"exempt, exact": {
+			path:       "/health",
+			remoteAddr: "192.0.2.1:1234",
+		},
+		"exempt, peer": {
+			path:       "/health",
+			remoteAddr: aliceAddr,
+		},
+		"not exempt, outsider": {
+			path:       "/admin",
+			remoteAddr: "192.0.2.1:1234",
+			wantStatus: http.StatusForbidden,
+		},
+		"not exempt, peer": {
+			path:       "/admin",
+			remoteAddr: aliceAddr,
+			wantEmail:  "alice@example.com",
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			calls := lc.whoisCalls.Load()
+			m.Cleanup()
+			r := newRequest(tc.remoteAddr)
+			r.URL.Path = tc.path
+			_, _, err := serve(t, m, r)
+			if got := statusCode(err); got != tc.wantStatus {
+				t.Errorf("got status %d (%v), want %d", got, err, tc.wantStatus)
+			}
+			if got := getVar(r, "tailscale.email"); got != tc.wantEmail {
+				t.Errorf("tailscale.email = %v, want %v", got, tc.wantEmail)
+			}
+			if tc.wantEmail == nil && lc.whoisCalls.Load() != calls {
+				t.Error("WhoIs called for an exempt path")
+			}
+		})
+	}
+}
+
+func TestEnforceOff(t *testing.T) {
+	lc := newFakeClient()
+	outer := &Middleware{}
+	lc.provision(t, outer)
+	m := &Middleware{Enforce: "off", AllowUsers: []string{"alice@example.com"}}
+	lc.provision(t, m)
+
+	for _, addr := range []string{aliceAddr, bobAddr} {
+		var (
+			whoisOK bool
+			email   any
+			auth    any
+		)
+		next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			_, whoisOK = WhoIsFromContext(r.Context())
+			email = getVar(r, "tailscale.email")
+			auth = getVar(r, "tailscale.authenticated")
+			return nil
+		})
+		// Run the request through an enforcing handler first, as if tsid
+		// was configured on the parent route.
+		inner := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			return m.ServeHTTP(w, r, next)
+		})
+		if err := outer.ServeHTTP(httptest.NewRecorder(), newRequest(addr), inner); err != nil {
+			t.Fatalf("%s: %v", addr, err)
+		}
+		if whoisOK {
+			t.Errorf("%s: WhoIsFromContext() reported true", addr)
+		}
+		if email != nil {
+			t.Errorf("%s: tailscale.email = %v, want unset", addr, email)
+		}
+		if auth != "false" {
+			t.Errorf("%s: tailscale.authenticated = %v, want \"false\"", addr, auth)
+		}
+	}
+}
+
+func TestEnforceOffNoWhoIs(t *testing.T) {
+	lc := newFakeClient()
+	lc.err = errTailscaledDown
+	m := &Middleware{Enforce: "off"}
+	lc.provision(t, m)
+
+	testAccess(t, m, []string{aliceAddr, "192.0.2.1:1234"}, nil)
+	if got := lc.whoisCalls.Load(); got != 0 {
+		t.Errorf("WhoIs called %d times, want 0", got)
+	}
+}
+
+func TestValidateEnforce(t *testing.T) {
+	m := &Middleware{Enforce: "maybe"}
+	if err := m.Provision(newContext(t)); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Validate(); err == nil {
+		t.Error("enforce maybe: got no error")
+	}
+}
+
+func TestHealthPath(t *testing.T) {
+	lc := newFakeClient()
+	lc.err = errTailscaledDown
+	m := &Middleware{HealthPath: "/healthz"}
+	lc.provision(t, m)
+
+	cases := map[string]struct {
+		path       string
+		remoteAddr string
+		wantStatus int // of the handler error, 0 for a response
+	}{
+		"health path, peer":     {path: "/healthz", remoteAddr: aliceAddr},
+		"health path, outsider": {path: "/healthz", remoteAddr: "192.0.2.1:1234"},
+		"subpath, outsider":     {path: "/healthz/db", remoteAddr: "192.0.2.1:1234", wantStatus: http.StatusForbidden},
+		"other path, outsider":  {path: "/", remoteAddr: "192.0.2.1:1234", wantStatus: http.StatusForbidden},
+		"other path, peer":      {path: "/", remoteAddr: aliceAddr, wantStatus: http.StatusServiceUnavailable},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			r := newRequest(tc.remoteAddr)
+			r.URL.Path = tc.path
+			w, called, err := serve(t, m, r)
+			if called {
+				t.Error("next handler called")
+			}
+			if got := statusCode(err); got != tc.wantStatus {
+				t.Fatalf("got status %d (%v), want %d", got, err, tc.wantStatus)
+			}
+			if tc.wantStatus == 0 && w.Code != http.StatusOK {
+				t.Errorf("response status = %d, want %d", w.Code, http.StatusOK)
+			}
+		})
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	lc := newFakeClient()
+	for addr, id := range map[string]tailcfg.StableNodeID{
+		"100.64.0.6": "nLaptop",
+		"100.64.0.7": "nPhone",
+	} {
+		lc.peers[netip.MustParseAddr(addr)] = &apitype.WhoIsResponse{
+			Node:        &tailcfg.Node{Name: "node.example.ts.net.", StableID: id},
+			UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"},
+		}
+	}
+	m := &Middleware{RateLimit: 2, RateLimitWindow: caddy.Duration(time.Hour)}
+	lc.provision(t, m)
+
+	for i := range 2 {
+		if _, called, err := serve(t, m, newRequest("100.64.0.6:1234")); err != nil || !called {
+			t.Fatalf("request %d: denied (err: %v), want allowed", i+1, err)
+		}
+	}
+	w, called, err := serve(t, m, newRequest("100.64.0.6:1234"))
+	if called || statusCode(err) != http.StatusTooManyRequests {
+		t.Fatalf("request over the limit: got status %d, want %d", statusCode(err), http.StatusTooManyRequests)
+	}
+	if got, want := w.Header().Get("Retry-After"), "1800"; got != want {
+		t.Errorf("Retry-After = %q, want %q", got, want)
+	}
+
+	// Other nodes of the same user are limited independently.
+	if _, called, err := serve(t, m, newRequest("100.64.0.7:1234")); err != nil || !called {
+		t.Errorf("another node: denied (err: %v), want allowed", err)
+	}
+}
+
+func TestUnauthenticatedRedirect(t *testing.T) {
+	lc := newFakeClient()
+
+	cases := map[string]struct {
+		redirect     string
+		remoteAddr   string
+		accept       string
+		wantStatus   int
+		wantLocation string
+	}{
+		"browser": {
+			redirect:     "https://example.com/join?from={http.request.host}",
+			remoteAddr:   "192.0.2.1:1234",
+			accept:       "text/html,application/xhtml+xml,*/*;q=0.8",
+			wantStatus:   http.StatusFound,
+			wantLocation: "https://example.com/join?from=example.com",
+		},
+		"not a browser": {
+			redirect:   "https://example.com/join",
+			remoteAddr: "192.0.2.1:1234",
+			accept:     "application/json",
+			wantStatus: http.StatusForbidden,
+		},
+		"disabled": {
+			remoteAddr: "192.0.2.1:1234",
+			accept:     "text/html",
+			wantStatus: http.StatusForbidden,
+		},
+		"unauthorized peer": {
+			redirect:   "https://example.com/join",
+			remoteAddr: "100.64.0.2:1234",
+			accept:     "text/html",
+			wantStatus: http.StatusForbidden,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			m := &Middleware{UnauthenticatedRedirect: tc.redirect}
+			lc.provision(t, m)
+			r := newRequest(tc.remoteAddr)
+			r.Header.Set("Accept", tc.accept)
+			w, called, err := serve(t, m, r)
+			if called {
+				t.Fatal("next handler called")
+			}
+			status := statusCode(err)
+			if err == nil {
+				status = w.Code
+			}
+			if status != tc.wantStatus {
+				t.Errorf("got status %d, want %d", status, tc.wantStatus)
+			}
+			if got := w.Header().Get("Location"); got != tc.wantLocation {
+				t.Errorf("Location = %q, want %q", got, tc.wantLocation)
+			}
+		})
+	}
+}
+
+func TestNodeLastSeen(t *testing.T) {
+	lastSeen := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+	cases := map[string]struct {
+		node *tailcfg.Node
+		want string
+	}{
+		"nil":     {node: nil, want: ""},
+		"online":  {node: &tailcfg.Node{Name: "laptop.example.ts.net."}, want: ""},
+		"offline": {node: &tailcfg.Node{Name: "laptop.example.ts.net.", LastSeen: &lastSeen}, want: "2024-05-01T12:30:00Z"},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			if got := nodeLastSeen(tc.node); got != tc.want {
+				t.Errorf("nodeLastSeen() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestNodeOnline(t *testing.T) {
+	online, offline := true, false
+	cases := map[string]struct {
+		node *tailcfg.Node
+		want string
+	}{
+		"nil":     {node: nil, want: "unknown"},
+		"unknown": {node: &tailcfg.Node{Name: "laptop.example.ts.net."}, want: "unknown"},
+		"online":  {node: &tailcfg.Node{Name: "laptop.example.ts.net.", Online: &online}, want: "true"},
+		"offline": {node: &tailcfg.Node{Name: "laptop.example.ts.net.", Online: &offline}, want: "false"},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			if got := nodeOnline(tc.node); got != tc.want {
+				t.Errorf("nodeOnline() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestNodeOnlinePlaceholder(t *testing.T) {
+	lc := newFakeClient()
+	offline := false
+	lc.peers[netip.MustParseAddr("100.64.0.6")] = &apitype.WhoIsResponse{
+		Node:        &tailcfg.Node{Name: "laptop.example.ts.net.", Online: &offline},
+		UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"},
+	}
+	m := &Middleware{AllowUsers: []string{"alice@example.com"}}
+	lc.provision(t, m)
+
+	for addr, want := range map[string]string{
+		"100.64.0.6:1234": "false",
+		aliceAddr:         "unknown",
+	} {
+		r := newRequest(addr)
+		if _, called, err := serve(t, m, r); err != nil || !called {
+			t.Fatalf("%s: denied (err: %v), want allowed", addr, err)
+		}
+		if got := getVar(r, "tailscale.node.online"); got != want {
+			t.Errorf("%s: tailscale.node.online = %v, want %q", addr, got, want)
+		}
+	}
+}
+
+func TestNodeLastSeenPlaceholder(t *testing.T) {
+	lc := newFakeClient()
+	lastSeen := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+	lc.peers[netip.MustParseAddr("100.64.0.6")] = &apitype.WhoIsResponse{
+		Node:        &tailcfg.Node{Name: "laptop.example.ts.net.", LastSeen: &lastSeen},
+		UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"},
+	}
+	m := &Middleware{}
+	lc.provision(t, m)
+
+	for addr, want := range map[string]string{
+		"100.64.0.6:1234": "2024-05-01T12:30:00Z",
+		aliceAddr:         "",
+	} {
+		r := newRequest(addr)
+		if _, _, err := serve(t, m, r); err != nil {
+			t.Fatal(err)
+		}
+		if got := getVar(r, "tailscale.node.last_seen"); got != want {
+			t.Errorf("%s: tailscale.node.last_seen = %v, want %q", addr, got, want)
+		}
+	}
+}
+
+func TestNodeTailnet(t *testing.T) {
+	cases := map[string]struct {
+		node *tailcfg.Node
+		want string
+	}{
+		"nil":       {node: nil, want: ""},
+		"magic dns": {node: &tailcfg.Node{Name: "laptop.Example.ts.net."}, want: "example.ts.net"},
+		"no dot":    {node: &tailcfg.Node{Name: "laptop"}, want: ""},
+		"empty":     {node: &tailcfg.Node{}, want: ""},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			if got := nodeTailnet(tc.node); got != tc.want {
+				t.Errorf("nodeTailnet() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAcceptTailnets(t *testing.T) {
+	lc := newFakeClient()
+	lc.peers[netip.MustParseAddr("100.64.0.6")] = &apitype.WhoIsResponse{
+		Node:        &tailcfg.Node{Name: "laptop.partner.ts.net.", Sharer: 45678},
+		UserProfile: &tailcfg.UserProfile{LoginName: "dave@partner.example"},
+	}
+	partnerAddr := "100.64.0.6:1234"
+
+	for _, tc := range []struct {
+		tailnets []string
+		allowed  []string
+		denied   []string
+	}{
+		{tailnets: nil, allowed: []string{aliceAddr, partnerAddr}},
+		{tailnets: []string{"Example.ts.net."}, allowed: []string{aliceAddr, bobAddr}, denied: []string{partnerAddr}},
+		{tailnets: []string{"example.ts.net", "partner.ts.net"}, allowed: []string{aliceAddr, partnerAddr}},
+	} {
+		m := &Middleware{AcceptTailnets: tc.tailnets}
+		lc.provision(t, m)
+		testAccess(t, m, tc.allowed, tc.denied)
+	}
+}
+
+func TestNodeAddrs(t *testing.T) {
+	prefixes := func(ss ...string) []netip.Prefix {
+		var ps []netip.Prefix
+		for _, s := range ss {
+			ps = append(ps, netip.MustParsePrefix(s))
+		}
+		return ps
+	}
+	cases := map[string]struct {
+		node      *tailcfg.Node
+		wantAddr4 string
+		wantAddr6 string
+	}{
+		"nil": {},
+		"both families": {
+			node:      &tailcfg.Node{Addresses: prefixes("100.64.0.1/32", "fd7a:115c:a1e0::1/128")},
+			wantAddr4: "100.64.0.1",
+			wantAddr6: "fd7a:115c:a1e0::1",
+		},
+		"IPv6 only": {
+			node:      &tailcfg.Node{Addresses: prefixes("fd7a:115c:a1e0::1/128")},
+			wantAddr6: "fd7a:115c:a1e0::1",
+		},
+		"non-Tailscale addresses": {
+			node:      &tailcfg.Node{Addresses: prefixes("192.0.2.1/32", "2001:db8::1/128", "100.64.0.1/32")},
+			wantAddr4: "100.64.0.1",
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			addr4, addr6 := nodeAddrs(tc.node)
+			if addr4 != tc.wantAddr4 || addr6 != tc.wantAddr6 {
+				t.Errorf("nodeAddrs() = %q, %q, want %q, %q", addr4, addr6, tc.wantAddr4, tc.wantAddr6)
+			}
+		})
+	}
+}
+
+func TestNodeAddrPlaceholders(t *testing.T) {
+	lc := newFakeClient()
+	lc.peers[netip.MustParseAddr("100.64.0.6")] = &apitype.WhoIsResponse{
+		Node: &tailcfg.Node{
+			Name: "laptop.example.ts.net.",
+			Addresses: []netip.Prefix{
+				netip.MustParsePrefix("100.64.0.6/32"),
+				netip.MustParsePrefix("fd7a:115c:a1e0::6/128"),
+			},
+		},
+		UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"},
+	}
+	m := &Middleware{}
+	lc.provision(t, m)
+
+	r := newRequest("100.64.0.6:1234")
+	if _, _, err := serve(t, m, r); err != nil {
+		t.Fatal(err)
+	}
+	if got := getVar(r, "tailscale.node.addr"); got != "100.64.0.6" {
+		t.Errorf("tailscale.node.addr = %v, want 100.64.0.6", got)
+	}
+	if got := getVar(r, "tailscale.node.addr6"); got != "fd7a:115c:a1e0::6" {
+		t.Errorf("tailscale.node.addr6 = %v, want fd7a:115c:a1e0::6", got)
+	}
+}
+
+func TestCapsPlaceholders(t *testing.T) {
+	lc := newFakeClient()
+	m := &Middleware{}
+	lc.provision(t, m)
+
+	cases := map[string]struct {
+		remoteAddr   string
+		wantCaps     string
+		wantCapCount string
+	}{
+		"several caps": {remoteAddr: aliceAddr, wantCaps: "example.com/cap/admin,example.com/cap/user", wantCapCount: "2"},
+		"one cap":      {remoteAddr: bobAddr, wantCaps: "example.com/cap/user", wantCapCount: "1"},
+		"no caps":      {remoteAddr: ciAddr, wantCaps: "", wantCapCount: "0"},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			r := newRequest(tc.remoteAddr)
+			if _, _, err := serve(t, m, r); err != nil {
+				t.Fatal(err)
+			}
+			if got := getVar(r, "tailscale.caps"); got != tc.wantCaps {
+				t.Errorf("tailscale.caps = %v, want %q", got, tc.wantCaps)
+			}
+			if got := getVar(r, "tailscale.cap_count"); got != tc.wantCapCount {
+				t.Errorf("tailscale.cap_count = %v, want %q", got, tc.wantCapCount)
+			}
+		})
+	}
+}
+
+func TestCapVersion(t *testing.T) {
+	cm := tailcfg.PeerCapMap{
+		"example.com/cap/v1":    {`{"version":1}`},
+		"example.com/cap/multi": {`{"version":1}`, `{"version":3}`, `{"version":2}`},
+		"example.com/cap/none":  {`{"role":"editor"}`},
+		"example.com/cap/bad":   {`{"version":"3"}`, `["junk"]`},
+	}
+	cases := map[string]int{
+		"example.com/cap/v1":      1,
+		"example.com/cap/multi":   3,
+		"example.com/cap/none":    0,
+		"example.com/cap/bad":     0,
+		"example.com/cap/missing": 0,
+	}
+	for capability, want := range cases {
+		if got := capVersion(cm, capability); got != want {
+			t.Errorf("capVersion(%q) = %d, want %d", capability, got, want)
+		}
+	}
+}
+
+func TestCapMinVersions(t *testing.T) {
+	lc := newFakeClient()
+	for addr, grants := range map[string][]tailcfg.RawMessage{
+		"100.64.0.6": {`{"version":1}`},
+		"100.64.0.7": {`{"version":2}`},
+		"100.64.0.8": {`{"version":1}`, `{"version":3}`},
+		"100.64.0.9": {`{}`},
+	} {
+		lc.peers[netip.MustParseAddr(addr)] = &apitype.WhoIsResponse{
+			Node:        &tailcfg.Node{Name: "node.example.ts.net."},
+			UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"},
+			CapMap:      tailcfg.PeerCapMap{"example.com/cap/app": grants},
+		}
+	}
+	m := &Middleware{
+		RequireCaps:    []string{"example.com/cap/app"},
+		CapMinVersions: map[string]int{"example.com/cap/app": 2},
+	}
+	lc.provision(t, m)
+
+	testAccess(t, m,
+		// At and above the minimum.
+		[]string{"100.64.0.7:1234", "100.64.0.8:1234"},
+		// Below the minimum, without a version, without the capability.
+		[]string{"100.64.0.6:1234", "100.64.0.9:1234", aliceAddr},
+	)
+}
@@ -0,0 +1,65 @@
+// © 2021 Ilya Mateyko. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package tsidtest_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.astrophena.name/tsid"
+	"go.astrophena.name/tsid/tsidtest"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+func ExampleNewClient() {
+	m := &tsid.Middleware{
+		AllowUsers: []string{"alice@example.com"},
+		Client: tsidtest.NewClient(tsidtest.Peers(map[netip.Addr]*apitype.WhoIsResponse{
+			netip.MustParseAddr("100.64.0.1"): {
+				Node:        &tailcfg.Node{Name: "laptop.example.ts.net."},
+				UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com", DisplayName: "Alice"},
+			},
+			netip.MustParseAddr("100.64.0.2"): {
+				Node:        &tailcfg.Node{Name: "desktop.example.ts.net."},
+				UserProfile: &tailcfg.UserProfile{LoginName: "bob@example.com", DisplayName: "Bob"},
+			},
+		})),
+	}
+	ctx, err := caddy.ProvisionContext(&caddy.Config{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := m.Provision(ctx); err != nil {
+		log.Fatal(err)
+	}
+	defer m.Cleanup()
+
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		fmt.Printf("%s: hello, %v\n", r.RemoteAddr, caddyhttp.GetVar(r.Context(), "tailscale.name"))
+		return nil
+	})
+	for _, addr := range []string{"100.64.0.1:1234", "100.64.0.2:1234", "100.64.0.3:1234"} {
+		r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		r.RemoteAddr = addr
+		r = r.WithContext(context.WithValue(r.Context(), caddyhttp.VarsCtxKey, map[string]any{}))
+		caddyhttp.NewTestReplacer(r)
+		var herr caddyhttp.HandlerError
+		if err := m.ServeHTTP(httptest.NewRecorder(), r, next); errors.As(err, &herr) {
+			fmt.Printf("%s: %d %v\n", addr, herr.StatusCode, herr.Err)
+		}
+	}
+	// Output:
+	// 100.64.0.1:1234: hello, Alice
+	// 100.64.0.2:1234: 403 not authorized
+	// 100.64.0.3:1234: 403 not authorized
+}
@@ -0,0 +1,90 @@
+// © 2021 Ilya Mateyko. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+// Package tsidtest provides a fake tailscaled client for testing Caddy
+// configurations and programs that use tsid without a running tailscaled.
+package tsidtest
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+
+	"go.astrophena.name/tsid"
+	"tailscale.com/client/local"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+)
+
+// Client is a fake tailscaled client. Set it as the Client of a
+// tsid.Middleware before provisioning it.
+type Client struct {
+	// WhoIsFunc answers WhoIs lookups. If nil, all addresses are unknown.
+	WhoIsFunc func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error)
+
+	// Status is returned by StatusWithoutPeers. If nil, a status with the
+	// example.ts.net tailnet is returned.
+	Status *ipnstate.Status
+}
+
+// NewClient returns a Client that answers WhoIs lookups with whois.
+func NewClient(whois func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error)) *Client {
+	return &Client{WhoIsFunc: whois}
+}
+
+// Peers returns a WhoIs function for NewClient that knows only about the
+// addresses in peers; other addresses are reported as unknown. As with
+// tailscaled, the Node and UserProfile of the responses may be nil.
+func Peers(peers map[netip.Addr]*apitype.WhoIsResponse) func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+	return func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+		ip, err := netip.ParseAddr(remoteAddr)
+		if err != nil {
+			ap, err := netip.ParseAddrPort(remoteAddr)
+			if err != nil {
+				return nil, err
+			}
+			ip = ap.Addr()
+		}
+		whois, ok := peers[ip]
+		if !ok {
+			return nil, local.ErrPeerNotFound
+		}
+		return whois, nil
+	}
+}
+
+// WhoIs implements the tsid.LocalClient interface.
+func (c *Client) WhoIs(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+	if c.WhoIsFunc == nil {
+		return nil, local.ErrPeerNotFound
+	}
+	return c.WhoIsFunc(ctx, remoteAddr)
+}
+
+// StatusWithoutPeers implements the tsid.LocalClient interface.
+func (c *Client) StatusWithoutPeers(ctx context.Context) (*ipnstate.Status, error) {
+	if c.Status != nil {
+		return c.Status, nil
+	}
+	return &ipnstate.Status{
+		BackendState: "Running",
+		CurrentTailnet: &ipnstate.TailnetStatus{
+			Name:           "example.com",
+			MagicDNSSuffix: "example.ts.net",
+		},
+		MagicDNSSuffix: "example.ts.net",
+	}, nil
+}
+
+// errNoIPNBus is returned by WatchIPNBus.
+var errNoIPNBus = errors.New("tsidtest: the IPN bus is not supported")
+
+// WatchIPNBus implements the tsid.LocalClient interface. The fake has no
+// IPN bus, so it always fails and tsid falls back to WhoIs lookups.
+func (c *Client) WatchIPNBus(ctx context.Context, mask ipn.NotifyWatchOpt) (*local.IPNBusWatcher, error) {
+	return nil, errNoIPNBus
+}
+
+var _ tsid.LocalClient = (*Client)(nil)
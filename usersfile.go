@@ -0,0 +1,132 @@
+// © 2021 Ilya Mateyko. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package tsid
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// usersFilePollInterval is how often the allowed users file is checked for
+// changes. It's a variable so tests can shorten it.
+var usersFilePollInterval = 5 * time.Second
+
+// usersFile is a set of login names loaded from a file, one per line,
+// that is reloaded when the file changes.
+type usersFile struct {
+	path   string
+	logger *zap.Logger
+	cancel context.CancelFunc
+	done   chan struct{} // closed when the poll loop exits
+
+	logins  atomic.Pointer[map[string]bool]
+	modTime time.Time // of the last loaded version, used only by poll
+}
+
+// loadUsersFile loads the login names from path and starts watching it
+// for changes until close is called.
+func loadUsersFile(path string, logger *zap.Logger) (*usersFile, error) {
+	f := &usersFile{
+		path:   path,
+		logger: logger,
+		done:   make(chan struct{}),
+	}
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	f.cancel = cancel
+	go f.poll(ctx)
+	return f, nil
+}
+
+// poll reloads the file when its modification time changes, until ctx is
+// canceled. Failed reloads keep the previous logins.
+func (f *usersFile) poll(ctx context.Context) {
+	defer close(f.done)
+	ticker := time.NewTicker(usersFilePollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		fi, err := os.Stat(f.path)
+		if err != nil {
+			f.logger.Warn("checking allowed users file failed", zap.String("path", f.path), zap.Error(err))
+			continue
+		}
+		if fi.ModTime().Equal(f.modTime) {
+			continue
+		}
+		if err := f.reload(); err != nil {
+			f.logger.Warn("reloading allowed users file failed, keeping the previous list", zap.String("path", f.path), zap.Error(err))
+			continue
+		}
+		f.logger.Info("reloaded allowed users file", zap.String("path", f.path))
+	}
+}
+
+// reload reads the file and replaces the logins with its contents.
+func (f *usersFile) reload() error {
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	b, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	logins, err := parseUsersFile(b)
+	if err != nil {
+		return fmt.Errorf("%s: %w", f.path, err)
+	}
+	f.logins.Store(&logins)
+	f.modTime = fi.ModTime()
+	return nil
+}
+
+// contains reports whether login is in the file. It's false for a nil
+// file.
+func (f *usersFile) contains(login string) bool {
+	if f == nil {
+		return false
+	}
+	return (*f.logins.Load())[login]
+}
+
+// close stops watching the file and waits for the poll loop to exit.
+func (f *usersFile) close() {
+	f.cancel()
+	<-f.done
+}
+
+// parseUsersFile parses login names, one per line. Blank lines and
+// comments starting with # are ignored.
+func parseUsersFile(b []byte) (map[string]bool, error) {
+	logins := make(map[string]bool)
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; sc.Scan(); n++ {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.ContainsAny(line, " \t") {
+			return nil, fmt.Errorf("line %d: malformed login %q", n, line)
+		}
+		logins[strings.ToLower(line)] = true
+	}
+	return logins, sc.Err()
+}
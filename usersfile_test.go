@@ -0,0 +1,119 @@
+// © 2021 Ilya Mateyko. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package tsid
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseUsersFile(t *testing.T) {
+	cases := map[string]struct {
+		in      string
+		want    map[string]bool
+		wantErr bool
+	}{
+		"empty": {
+			in:   "",
+			want: map[string]bool{},
+		},
+		"logins": {
+			in: "# Admins\n" +
+				"Alice@Example.com\n" +
+				"\n" +
+				"  bob@example.org   # on call\n",
+			want: map[string]bool{"alice@example.com": true, "bob@example.org": true},
+		},
+		"malformed": {
+			in:      "alice@example.com bob@example.org\n",
+			wantErr: true,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got, err := parseUsersFile([]byte(tc.in))
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("got error %v, want error: %v", err, tc.wantErr)
+			}
+			if !tc.wantErr && !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// writeUsersFile replaces path with a file holding content, modified age
+// ago, so that each change is noticed even on file systems with a coarse
+// time resolution. The file is replaced by renaming, so that the poller
+// never reads a partially written one.
+func writeUsersFile(t *testing.T, path, content string, age time.Duration) {
+	t.Helper()
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(-age)
+	if err := os.Chtimes(tmp, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAllowUsersFile(t *testing.T) {
+	defer func(d time.Duration) { usersFilePollInterval = d }(usersFilePollInterval)
+	usersFilePollInterval = time.Millisecond
+
+	path := filepath.Join(t.TempDir(), "users")
+	writeUsersFile(t, path, "# Initial\nBob@example.org\n", time.Hour)
+
+	lc := newFakeClient()
+	m := &Middleware{AllowUsersFile: path}
+	lc.provision(t, m)
+	t.Cleanup(func() { m.Cleanup() })
+
+	// Initial load.
+	testAccess(t, m, []string{bobAddr}, []string{aliceAddr, ciAddr})
+
+	// Reload on change.
+	writeUsersFile(t, path, "alice@example.com\n", time.Minute)
+	waitFor(t, func() bool { return m.usersFile.contains("alice@example.com") })
+	testAccess(t, m, []string{aliceAddr}, []string{bobAddr, ciAddr})
+
+	// A malformed file keeps the last good list.
+	writeUsersFile(t, path, "alice@example.com bob@example.org\n", 0)
+	time.Sleep(20 * time.Millisecond)
+	testAccess(t, m, []string{aliceAddr}, []string{bobAddr, ciAddr})
+}
+
+func TestAllowUsersFileWithAllowUsers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users")
+	writeUsersFile(t, path, "bob@example.org\n", 0)
+
+	lc := newFakeClient()
+	m := &Middleware{AllowUsers: []string{"alice@example.com"}, AllowUsersFile: path}
+	lc.provision(t, m)
+	t.Cleanup(func() { m.Cleanup() })
+
+	testAccess(t, m, []string{aliceAddr, bobAddr}, []string{ciAddr})
+}
+
+func TestProvisionAllowUsersFile(t *testing.T) {
+	dir := t.TempDir()
+	malformed := filepath.Join(dir, "malformed")
+	writeUsersFile(t, malformed, "alice@example.com bob@example.org\n", 0)
+
+	for _, path := range []string{filepath.Join(dir, "missing"), malformed} {
+		m := &Middleware{AllowUsersFile: path, Client: newFakeClient()}
+		if err := m.Provision(newContext(t)); err == nil {
+			t.Errorf("%s: got no error", path)
+			m.Cleanup()
+		}
+	}
+}